@@ -2,9 +2,16 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/zafchiel/image-service/internal/cache"
 	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/fetch"
 	"github.com/zafchiel/image-service/internal/handlers"
 	"github.com/zafchiel/image-service/internal/models"
 	"github.com/zafchiel/image-service/internal/session"
@@ -16,22 +23,55 @@ import (
 func main() {
 	cfg := config.Load()
 
-	db, err := gorm.Open(sqlite.Open(cfg.DBPath), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(sqliteDSN(cfg.DBPath)), &gorm.Config{})
 	if err != nil {
 		panic("failed to connect database: " + err.Error())
 	}
 
 	session.InitStore(cfg.SessionSecrectKey)
 
+	if cfg.RequireSignedURLs && cfg.URLSigningKey == "" {
+		panic("REQUIRE_SIGNED_URLS is set but URL_SIGNING_KEY is empty")
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		panic("failed to initialize storage: " + err.Error())
+	}
+
+	presets, err := handlers.LoadPresets(cfg.PresetsPath, cfg)
+	if err != nil {
+		panic("failed to load presets: " + err.Error())
+	}
+
+	imageCache, err := newCache(cfg)
+	if err != nil {
+		panic("failed to initialize cache: " + err.Error())
+	}
+
+	fetcher, err := newFetcher(cfg)
+	if err != nil {
+		panic("failed to initialize fetcher: " + err.Error())
+	}
+
 	app := &handlers.App{
 		DB:      db,
-		Storage: storage.NewLocalStorage(cfg.StoragePath),
+		Storage: store,
+		Cache:   imageCache,
+		Presets: presets,
+		Fetcher: fetcher,
 		Config:  cfg,
 	}
 
-	if err := db.AutoMigrate(&models.ImageMetadata{}, &models.User{}); err != nil {
+	if err := db.AutoMigrate(&models.ImageMetadata{}, &models.User{}, &models.Tag{}, &models.ImageDetails{}, &models.ImageProperty{}, &models.Album{}, &models.AlbumImage{}, &models.APIKey{}, &models.RefreshToken{}, &models.Upload{}, &models.UploadChunk{}, &models.Blob{}); err != nil {
 		panic("failed to run auto migrations: " + err.Error())
 	}
+	if err := models.MigrateBlobs(db); err != nil {
+		panic("failed to migrate blobs: " + err.Error())
+	}
+
+	go expireUploads(app)
+	go expireRefreshTokens(app)
 
 	server := http.Server{
 		Addr:    cfg.ServerAddress,
@@ -43,3 +83,84 @@ func main() {
 		panic("failed to start server: " + err.Error())
 	}
 }
+
+// sqliteDSN makes transactions take the write lock when they begin, so
+// concurrent ones wait for each other. Transactions that read before
+// writing otherwise deadlock, and SQLite fails one with "database is
+// locked".
+func sqliteDSN(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + "_txlock=immediate"
+}
+
+// expireUploads periodically removes abandoned resumable uploads
+func expireUploads(app *handlers.App) {
+	for range time.Tick(time.Hour) {
+		if err := handlers.ExpireUploads(app); err != nil {
+			log.Println("failed to expire uploads:", err)
+		}
+	}
+}
+
+// expireRefreshTokens periodically removes refresh tokens past their expiry
+func expireRefreshTokens(app *handlers.App) {
+	for range time.Tick(time.Hour) {
+		if err := handlers.ExpireRefreshTokens(app); err != nil {
+			log.Println("failed to expire refresh tokens:", err)
+		}
+	}
+}
+
+func newFetcher(cfg *config.Config) (*fetch.Client, error) {
+	networks := make([]netip.Prefix, 0, len(cfg.FetchAllowedCIDRs))
+	for _, cidr := range cfg.FetchAllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, prefix)
+	}
+
+	return fetch.NewClient(fetch.Config{
+		Timeout:         cfg.FetchTimeout,
+		MaxRedirects:    cfg.FetchMaxRedirects,
+		MaxSize:         cfg.MaxUploadSize,
+		AllowedHosts:    cfg.FetchAllowedHosts,
+		AllowedNetworks: networks,
+	}), nil
+}
+
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "local":
+		return storage.NewLocalStorage(cfg.StoragePath), nil
+	case "s3":
+		return storage.NewS3Storage(storage.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+			PathStyle: cfg.S3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+func newCache(cfg *config.Config) (cache.Cache, error) {
+	tiers := []cache.Cache{cache.NewMemoryCache(cfg.CacheMaxBytes)}
+	if cfg.CacheDiskEnabled {
+		diskCache, err := cache.NewDiskCache(filepath.Join(cfg.StoragePath, "cache"), cfg.CacheDiskMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, diskCache)
+	}
+	return cache.NewTiered(tiers...), nil
+}
@@ -0,0 +1,64 @@
+package cache
+
+// Key identifies a transformed variant of a stored image.
+type Key struct {
+	ImageID uint
+	// Canonicalized transformation spec, e.g. "blur=2&h=200&w=300"
+	Spec   string
+	Format string
+}
+
+// Entry is an encoded image variant ready to be written to the client.
+type Entry struct {
+	ContentType string
+	Data        []byte
+}
+
+type Cache interface {
+	Get(key Key) (*Entry, bool)
+	Set(key Key, entry *Entry) error
+	// Invalidate drops every cached variant of the given image
+	Invalidate(imageID uint) error
+}
+
+// Tiered chains several caches, the fastest first. Hits in a lower tier
+// are promoted to the tiers above it.
+type Tiered struct {
+	tiers []Cache
+}
+
+func NewTiered(tiers ...Cache) *Tiered {
+	return &Tiered{tiers: tiers}
+}
+
+func (t *Tiered) Get(key Key) (*Entry, bool) {
+	for i, tier := range t.tiers {
+		entry, ok := tier.Get(key)
+		if !ok {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			t.tiers[j].Set(key, entry)
+		}
+		return entry, true
+	}
+	return nil, false
+}
+
+func (t *Tiered) Set(key Key, entry *Entry) error {
+	for _, tier := range t.tiers {
+		if err := tier.Set(key, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tiered) Invalidate(imageID uint) error {
+	for _, tier := range t.tiers {
+		if err := tier.Invalidate(imageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type diskItem struct {
+	path    string
+	imageID uint
+	size    int64
+}
+
+// DiskCache stores variants as files grouped in one directory per image,
+// so invalidating an image is a single directory removal. Like
+// MemoryCache it's bounded by the total size of the files and evicts the
+// least recently used ones first. Access times are kept as file
+// modification times, so the order survives restarts.
+type DiskCache struct {
+	root     string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+// NewDiskCache indexes the variants already cached under root, evicting
+// them when they're over maxBytes
+func NewDiskCache(root string, maxBytes int64) (*DiskCache, error) {
+	dc := &DiskCache{
+		root:     root,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (dc *DiskCache) Get(key Key) (*Entry, bool) {
+	fullPath := dc.path(key)
+
+	dc.mu.Lock()
+	el, ok := dc.items[fullPath]
+	if ok {
+		dc.order.MoveToFront(el)
+	}
+	dc.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	// The first line holds the content type, the rest is the encoded image
+	reader := bufio.NewReader(file)
+	contentType, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(fullPath, now, now)
+
+	return &Entry{ContentType: strings.TrimSuffix(contentType, "\n"), Data: data}, true
+}
+
+func (dc *DiskCache) Set(key Key, entry *Entry) error {
+	entrySize := int64(len(entry.ContentType) + 1 + len(entry.Data))
+	// Entries larger than the whole budget would only evict everything else
+	if entrySize > dc.maxBytes {
+		return nil
+	}
+
+	fullPath := dc.path(key)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial entries
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(entry.ContentType + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(entry.Data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return err
+	}
+	dc.add(&diskItem{path: fullPath, imageID: key.ImageID, size: entrySize})
+	dc.evict()
+	return nil
+}
+
+func (dc *DiskCache) Invalidate(imageID uint) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	for _, el := range dc.items {
+		if el.Value.(*diskItem).imageID == imageID {
+			dc.removeElement(el)
+		}
+	}
+	return os.RemoveAll(dc.imageDir(imageID))
+}
+
+// load indexes the cached files from the least to the most recently used,
+// removing temporary files left by writes that didn't finish
+func (dc *DiskCache) load() error {
+	type cachedFile struct {
+		item    *diskItem
+		modTime time.Time
+	}
+	var files []cachedFile
+
+	err := filepath.WalkDir(dc.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dc.root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+
+		imageID, err := strconv.ParseUint(filepath.Base(filepath.Dir(path)), 10, 64)
+		if err != nil {
+			// Not a variant
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		item := &diskItem{path: path, imageID: uint(imageID), size: info.Size()}
+		files = append(files, cachedFile{item: item, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		dc.add(file.item)
+	}
+	dc.evict()
+	return nil
+}
+
+// add indexes a file as the most recently used, replacing an earlier
+// version of it
+func (dc *DiskCache) add(item *diskItem) {
+	if el, ok := dc.items[item.path]; ok {
+		dc.order.Remove(el)
+		dc.size -= el.Value.(*diskItem).size
+	}
+	dc.items[item.path] = dc.order.PushFront(item)
+	dc.size += item.size
+}
+
+func (dc *DiskCache) evict() {
+	for dc.size > dc.maxBytes {
+		el := dc.order.Back()
+		dc.removeElement(el)
+		os.Remove(el.Value.(*diskItem).path)
+	}
+}
+
+func (dc *DiskCache) removeElement(el *list.Element) {
+	item := dc.order.Remove(el).(*diskItem)
+	delete(dc.items, item.path)
+	dc.size -= item.size
+}
+
+func (dc *DiskCache) imageDir(imageID uint) string {
+	return filepath.Join(dc.root, strconv.FormatUint(uint64(imageID), 10))
+}
+
+func (dc *DiskCache) path(key Key) string {
+	hash := sha256.Sum256([]byte(key.Spec))
+	return filepath.Join(dc.imageDir(key.ImageID), hex.EncodeToString(hash[:])+"."+key.Format)
+}
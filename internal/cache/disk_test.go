@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Each entry takes 100 bytes on disk with its content type line
+func testEntry() *Entry {
+	return &Entry{ContentType: "image/png", Data: bytes.Repeat([]byte{1}, 90)}
+}
+
+func variant(imageID uint, spec string) Key {
+	return Key{ImageID: imageID, Spec: spec, Format: "png"}
+}
+
+func cachedFiles(t *testing.T, root string) int {
+	t.Helper()
+	count := 0
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return err
+	})
+	return count
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"w=1", "w=2", "w=3"} {
+		if err := dc.Set(variant(1, spec), testEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// w=1 becomes the most recently used, so w=2 goes first
+	if _, ok := dc.Get(variant(1, "w=1")); !ok {
+		t.Fatal("w=1 missing before the budget was reached")
+	}
+	dc.Set(variant(2, "w=4"), testEntry())
+
+	for spec, want := range map[string]bool{"w=1": true, "w=2": false, "w=3": true} {
+		if _, ok := dc.Get(variant(1, spec)); ok != want {
+			t.Errorf("Get(%s) hit = %v, want %v", spec, ok, want)
+		}
+	}
+	if n := cachedFiles(t, root); n != 3 {
+		t.Errorf("%d files cached, want 3", n)
+	}
+
+	// Entries over the whole budget aren't stored
+	dc.Set(variant(1, "big"), &Entry{ContentType: "image/png", Data: make([]byte, 400)})
+	if _, ok := dc.Get(variant(1, "big")); ok {
+		t.Error("entry larger than the budget was cached")
+	}
+}
+
+func TestDiskCacheInvalidateFreesBudget(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.Set(variant(1, "w=1"), testEntry())
+	dc.Set(variant(1, "w=2"), testEntry())
+	if err := dc.Invalidate(1); err != nil {
+		t.Fatal(err)
+	}
+	dc.Set(variant(2, "w=1"), testEntry())
+	dc.Set(variant(2, "w=2"), testEntry())
+
+	for _, key := range []Key{variant(2, "w=1"), variant(2, "w=2")} {
+		if _, ok := dc.Get(key); !ok {
+			t.Errorf("Get(%v) missed, invalidated entries still count against the budget", key)
+		}
+	}
+}
+
+func TestDiskCacheReloadsEntries(t *testing.T) {
+	root := t.TempDir()
+	dc, err := NewDiskCache(root, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, spec := range []string{"w=1", "w=2", "w=3"} {
+		dc.Set(variant(1, spec), testEntry())
+		// Modification times order the entries when they're reloaded
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(dc.path(variant(1, spec)), modTime, modTime)
+	}
+	os.WriteFile(filepath.Join(root, "1", ".tmp-123"), []byte("partial"), 0o644)
+
+	// A smaller budget evicts the oldest entries on load
+	dc, err = NewDiskCache(root, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for spec, want := range map[string]bool{"w=1": false, "w=2": true, "w=3": true} {
+		if _, ok := dc.Get(variant(1, spec)); ok != want {
+			t.Errorf("Get(%s) hit = %v, want %v", spec, ok, want)
+		}
+	}
+	if n := cachedFiles(t, root); n != 2 {
+		t.Errorf("%d files cached, want 2 without the temporary file", n)
+	}
+}
+
+func TestDiskCacheMissingRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "cache")
+	dc, err := NewDiskCache(root, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Set(variant(1, "w=1"), testEntry()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dc.Get(variant(1, "w=1")); !ok {
+		t.Error("Get missed after Set")
+	}
+}
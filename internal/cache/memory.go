@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type memoryItem struct {
+	key   Key
+	entry *Entry
+}
+
+// MemoryCache is an LRU cache bounded by the total size of the cached data.
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[Key]*list.Element
+}
+
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[Key]*list.Element),
+	}
+}
+
+func (mc *MemoryCache) Get(key Key) (*Entry, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	el, ok := mc.items[key]
+	if !ok {
+		return nil, false
+	}
+	mc.order.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (mc *MemoryCache) Set(key Key, entry *Entry) error {
+	entrySize := int64(len(entry.Data))
+	// Entries larger than the whole budget would only evict everything else
+	if entrySize > mc.maxBytes {
+		return nil
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if el, ok := mc.items[key]; ok {
+		mc.removeElement(el)
+	}
+
+	el := mc.order.PushFront(&memoryItem{key: key, entry: entry})
+	mc.items[key] = el
+	mc.size += entrySize
+
+	for mc.size > mc.maxBytes {
+		mc.removeElement(mc.order.Back())
+	}
+	return nil
+}
+
+func (mc *MemoryCache) Invalidate(imageID uint) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for key, el := range mc.items {
+		if key.ImageID == imageID {
+			mc.removeElement(el)
+		}
+	}
+	return nil
+}
+
+func (mc *MemoryCache) removeElement(el *list.Element) {
+	item := mc.order.Remove(el).(*memoryItem)
+	delete(mc.items, item.key)
+	mc.size -= int64(len(item.entry.Data))
+}
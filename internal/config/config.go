@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	DBPath            string
@@ -8,15 +13,116 @@ type Config struct {
 	ServerAddress     string
 	MaxUploadSize     int64
 	SessionSecrectKey string
+
+	// Base URL used when building links returned to clients
+	PublicURL string
+
+	// Byte budget of the in-memory transformed variant cache
+	CacheMaxBytes int64
+	// Keep transformed variants on disk under StoragePath as a second tier
+	CacheDiskEnabled bool
+	// Byte budget of the disk tier, the least recently used variants are
+	// deleted above it
+	CacheDiskMaxBytes int64
+
+	// Either "local" or "s3"
+	StorageBackend string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3Prefix       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3UseSSL       bool
+	S3PathStyle    bool
+
+	// Quality used for lossy output when the request doesn't set q
+	DefaultQuality int
+	// Upper bound for the q parameter, higher requests are clamped
+	MaxQuality int
+	// One of "default", "none", "fast" or "best"
+	PNGCompression string
+
+	// HMAC key for signed image URLs, signing is disabled when empty
+	URLSigningKey string
+	// Reject unsigned requests that transform or transcode images
+	RequireSignedURLs bool
+
+	// JSON file with named transformation presets
+	PresetsPath string
+	// Only allow preset transformations
+	PresetsOnly bool
+
+	// Images are rejected before decoding when their pixel count or either
+	// dimension is over these limits
+	MaxImagePixels    int64
+	MaxImageDimension int
+	// Upper bound for requested output width and height
+	MaxOutputDimension int
+
+	// How long an incomplete resumable upload is kept
+	UploadExpiry time.Duration
+
+	// Limits for fetching images from remote URLs
+	FetchTimeout      time.Duration
+	FetchMaxRedirects int
+	// Only fetch from these hosts and their subdomains, any public host
+	// when empty
+	FetchAllowedHosts []string
+	// CIDRs exempt from the private and loopback address blocking
+	FetchAllowedCIDRs []string
+
+	// Strip EXIF, GPS and other metadata from uploads and served originals
+	// unless a request opts out
+	StripMetadata bool
+
+	// HMAC key for JWT access tokens, POST /token is disabled when empty
+	JWTSigningKey string
+	// Lifetimes of access tokens and of refresh tokens, which are replaced
+	// on every use
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
 }
 
 func Load() *Config {
 	return &Config{
-		DBPath:            getEnv("DB_PATH", "sqlite.db"),
-		StoragePath:       getEnv("STORAGE_PATH", "assets"),
-		ServerAddress:     getEnv("PORT", ":8080"),
-		MaxUploadSize:     10 << 20, // 10 MB
-		SessionSecrectKey: getEnv("SECRET_SESSION_KEY", ""),
+		DBPath:             getEnv("DB_PATH", "sqlite.db"),
+		StoragePath:        getEnv("STORAGE_PATH", "assets"),
+		ServerAddress:      getEnv("PORT", ":8080"),
+		PublicURL:          getEnv("PUBLIC_URL", "http://localhost:8080"),
+		MaxUploadSize:      getEnvInt64("MAX_UPLOAD_SIZE", 10<<20), // 10 MB per file
+		SessionSecrectKey:  getEnv("SECRET_SESSION_KEY", ""),
+		CacheMaxBytes:      getEnvInt64("CACHE_MAX_BYTES", 64<<20), // 64 MB
+		CacheDiskEnabled:   getEnvBool("CACHE_DISK_ENABLED", true),
+		CacheDiskMaxBytes:  getEnvInt64("CACHE_DISK_MAX_BYTES", 1<<30), // 1 GB
+		StorageBackend:     getEnv("STORAGE_BACKEND", "local"),
+		S3Endpoint:         getEnv("S3_ENDPOINT", "s3.amazonaws.com"),
+		S3Region:           getEnv("S3_REGION", ""),
+		S3Bucket:           getEnv("S3_BUCKET", ""),
+		S3Prefix:           getEnv("S3_PREFIX", ""),
+		S3AccessKey:        getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:        getEnv("S3_SECRET_KEY", ""),
+		S3UseSSL:           getEnvBool("S3_USE_SSL", true),
+		S3PathStyle:        getEnvBool("S3_PATH_STYLE", false),
+		DefaultQuality:     int(getEnvInt64("DEFAULT_QUALITY", 80)),
+		MaxQuality:         int(getEnvInt64("MAX_QUALITY", 95)),
+		PNGCompression:     getEnv("PNG_COMPRESSION", "default"),
+		URLSigningKey:      getEnv("URL_SIGNING_KEY", ""),
+		RequireSignedURLs:  getEnvBool("REQUIRE_SIGNED_URLS", false),
+		PresetsPath:        getEnv("PRESETS_PATH", ""),
+		PresetsOnly:        getEnvBool("PRESETS_ONLY", false),
+		StripMetadata:      getEnvBool("STRIP_METADATA", false),
+		MaxImagePixels:     getEnvInt64("MAX_IMAGE_PIXELS", 50_000_000),
+		MaxImageDimension:  int(getEnvInt64("MAX_IMAGE_DIMENSION", 16384)),
+		MaxOutputDimension: int(getEnvInt64("MAX_OUTPUT_DIMENSION", 8192)),
+		UploadExpiry:       getEnvDuration("UPLOAD_EXPIRY", 24*time.Hour),
+		FetchTimeout:       getEnvDuration("FETCH_TIMEOUT", 10*time.Second),
+		FetchMaxRedirects:  int(getEnvInt64("FETCH_MAX_REDIRECTS", 3)),
+		FetchAllowedHosts:  getEnvList("FETCH_ALLOWED_HOSTS"),
+		FetchAllowedCIDRs:  getEnvList("FETCH_ALLOWED_CIDRS"),
+		JWTSigningKey:      getEnv("JWT_SIGNING_KEY", ""),
+		AccessTokenTTL:     getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:    getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
 	}
 }
 
@@ -26,3 +132,41 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt64(key string, fallback int64) int64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// getEnvList splits a comma separated variable, ignoring empty items
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
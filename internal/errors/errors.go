@@ -7,6 +7,39 @@ var (
 	ErrImageNotFound   = errors.New("image not found")
 	ErrInvalidID       = errors.New("invalid ID")
 	ErrFileTooLarge    = errors.New("file too large")
+	ErrRequestTooLarge = errors.New("request body too large")
 	ErrInvalidFormat   = errors.New("invalid image format")
 	ErrNoImageUploaded = errors.New("no image uploaded")
+	ErrNotImageOwner   = errors.New("only the owner can modify this image")
+	ErrFormatMismatch  = errors.New("file content doesn't match its declared type")
+	ErrPolyglotFile    = errors.New("file contains data other than the image")
+	ErrCorruptImage    = errors.New("image is corrupt or truncated")
+
+	ErrTooManyProperties = errors.New("too many metadata keys")
+	ErrAlbumNotFound     = errors.New("album not found")
+	ErrTagNotFound       = errors.New("tag not found")
+	ErrTagExists         = errors.New("a tag with this name already exists")
+
+	ErrUnsupportedOutputFormat = errors.New("unsupported output format, use one of: jpeg, png, gif, webp, auto")
+	ErrInvalidQuality          = errors.New("invalid quality, use a number between 1 and 100")
+	ErrInvalidCompression      = errors.New("invalid compression, use one of: default, none, fast, best")
+	ErrInvalidTransformation   = errors.New("invalid transformation")
+	ErrSignatureRequired       = errors.New("transformations require a signed URL")
+	ErrPresetNotFound          = errors.New("preset not found")
+	ErrPresetRequired          = errors.New("only preset transformations are allowed")
+	ErrImageTooLarge           = errors.New("image dimensions exceed the allowed limit")
+	ErrOutputTooLarge          = errors.New("requested output dimensions exceed the allowed limit")
+	ErrInvalidFrame            = errors.New("invalid frame, use a frame number of the image or poster")
+
+	ErrUploadNotFound        = errors.New("upload not found")
+	ErrUploadExpired         = errors.New("upload expired")
+	ErrUploadOffsetMismatch  = errors.New("upload offset doesn't match the received data")
+	ErrUnsupportedTusVersion = errors.New("unsupported tus version, use 1.0.0")
+
+	ErrInvalidAPIKey  = errors.New("invalid, expired or revoked API key")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidScope   = errors.New("invalid scope")
+
+	ErrInvalidAccessToken  = errors.New("invalid or expired access token")
+	ErrInvalidRefreshToken = errors.New("invalid, expired or revoked refresh token")
 )
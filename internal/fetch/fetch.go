@@ -0,0 +1,201 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidURL       = errors.New("only http and https URLs can be fetched")
+	ErrHostNotAllowed   = errors.New("host is not allowed")
+	ErrBlockedAddress   = errors.New("address is not allowed")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrUnexpectedStatus = errors.New("unexpected response status")
+	ErrResponseTooLarge = errors.New("response is too large")
+)
+
+// Ranges that aren't reachable from the internet, on top of the loopback,
+// private, link-local, multicast and unspecified addresses net/netip knows
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can reach IPv4 ranges
+}
+
+type Config struct {
+	Timeout      time.Duration
+	MaxRedirects int
+	// Larger responses are rejected, up front when they declare their
+	// Content-Length and otherwise once that much was read
+	MaxSize int64
+	// When not empty, only these hosts and their subdomains are fetched
+	AllowedHosts []string
+	// Networks exempt from the private address blocking
+	AllowedNetworks []netip.Prefix
+}
+
+// Client fetches remote files without letting the URL reach the server's
+// own network. Addresses are checked when connecting, after DNS
+// resolution, so a host can't resolve to a public address when checked
+// and a private one when used.
+type Client struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewClient(cfg Config) *Client {
+	c := &Client{cfg: cfg}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: c.checkAddress,
+	}
+	transport := &http.Transport{
+		// Proxies would connect on our behalf, bypassing the checks
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+	}
+
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return c.checkURL(req.URL)
+		},
+	}
+	return c
+}
+
+// Response is a successful response, the caller has to close Body
+type Response struct {
+	Body        io.ReadCloser
+	ContentType string
+	// Final URL after redirects
+	URL *url.URL
+}
+
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	if err := c.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+	}
+	if c.cfg.MaxSize > 0 && resp.ContentLength > c.cfg.MaxSize {
+		resp.Body.Close()
+		return nil, ErrResponseTooLarge
+	}
+
+	body := resp.Body
+	if c.cfg.MaxSize > 0 {
+		body = &limitedBody{ReadCloser: body, remaining: c.cfg.MaxSize}
+	}
+	return &Response{Body: body, ContentType: resp.Header.Get("Content-Type"), URL: resp.Request.URL}, nil
+}
+
+// limitedBody fails with ErrResponseTooLarge once more than remaining
+// bytes are read, instead of silently truncating the response
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// One byte more than allowed tells a response of exactly the limit
+	// from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+func (c *Client) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return ErrInvalidURL
+	}
+	if len(c.cfg.AllowedHosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range c.cfg.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+}
+
+// checkAddress runs for every connection with the resolved address
+func (c *Client) checkAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+
+	for _, allowed := range c.cfg.AllowedNetworks {
+		if allowed.Contains(addr) {
+			return nil
+		}
+	}
+	if isBlocked(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+	}
+	return nil
+}
+
+func isBlocked(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var loopback = netip.MustParsePrefix("127.0.0.0/8")
+
+func newTestClient(cfg Config) *Client {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return NewClient(cfg)
+}
+
+func TestIsBlocked(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"64:ff9b::a00:1", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := isBlocked(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("isBlocked(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+}
+
+func TestGetBlocksLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the server")
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(Config{}).Get(context.Background(), server.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("Get = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestGetBlocksRedirectToPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.RedirectHandler("http://10.0.0.1/image.png", http.StatusFound))
+	defer server.Close()
+
+	client := newTestClient(Config{MaxRedirects: 5, AllowedNetworks: []netip.Prefix{loopback}})
+	_, err := client.Get(context.Background(), server.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("Get = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestGetChecksRedirectHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := strings.Replace("http://"+r.Host, "127.0.0.1", "localhost", 1)
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer server.Close()
+
+	client := newTestClient(Config{
+		MaxRedirects:    5,
+		AllowedHosts:    []string{"127.0.0.1"},
+		AllowedNetworks: []netip.Prefix{loopback},
+	})
+	_, err := client.Get(context.Background(), server.URL)
+	if !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("Get = %v, want ErrHostNotAllowed", err)
+	}
+}
+
+func TestGetLimitsRedirects(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "/next", http.StatusFound)
+	}))
+	defer server.Close()
+
+	client := newTestClient(Config{MaxRedirects: 2, AllowedNetworks: []netip.Prefix{loopback}})
+	_, err := client.Get(context.Background(), server.URL)
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Get = %v, want ErrTooManyRedirects", err)
+	}
+	if requests != 3 {
+		t.Errorf("server got %d requests, want 3", requests)
+	}
+}
+
+func TestGetLimitsSize(t *testing.T) {
+	const maxSize = 1024
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := maxSize
+		if r.URL.Path != "/exact" {
+			size++
+		}
+		if r.URL.Path == "/declared" {
+			w.Header().Set("Content-Length", "1025")
+		}
+		// Flushing first sends the body chunked, without a length
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+	defer server.Close()
+
+	client := newTestClient(Config{MaxSize: maxSize, AllowedNetworks: []netip.Prefix{loopback}})
+
+	if _, err := client.Get(context.Background(), server.URL+"/declared"); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("Get with a large Content-Length = %v, want ErrResponseTooLarge", err)
+	}
+
+	resp, err := client.Get(context.Background(), server.URL+"/chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("reading a large chunked body = %v, want ErrResponseTooLarge", err)
+	}
+	if len(data) > maxSize {
+		t.Errorf("read %d bytes, want at most %d", len(data), maxSize)
+	}
+
+	resp, err = client.Get(context.Background(), server.URL+"/exact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(data) != maxSize {
+		t.Errorf("reading a body of exactly the limit = %d bytes, %v", len(data), err)
+	}
+}
@@ -0,0 +1,533 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAlbumName = 200
+	// Upper bound for the number of images in an album, membership is
+	// rewritten as a whole when the order changes
+	maxAlbumSize = 10000
+)
+
+type AlbumResponse struct {
+	ID           uint      `json:"id"`
+	Name         string    `json:"name"`
+	CoverImageID *uint     `json:"cover_image_id"`
+	CoverURL     string    `json:"cover_url,omitempty"`
+	ImageCount   int64     `json:"image_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func newAlbumResponse(album *models.Album, imageCount int64, app *App) AlbumResponse {
+	response := AlbumResponse{
+		ID:           album.ID,
+		Name:         album.Name,
+		CoverImageID: album.CoverImageID,
+		ImageCount:   imageCount,
+		CreatedAt:    album.CreatedAt,
+		UpdatedAt:    album.UpdatedAt,
+	}
+	if album.CoverImageID != nil {
+		response.CoverURL = fmt.Sprintf("%s/image/%d", app.Config.PublicURL, *album.CoverImageID)
+	}
+	return response
+}
+
+type AlbumsHandler struct {
+	app *App
+}
+
+func NewAlbumsHandler(app *App) *AlbumsHandler {
+	return &AlbumsHandler{app: app}
+}
+
+type albumRequestBody struct {
+	Name *string `json:"name"`
+	// 0 removes the cover
+	CoverImageID *uint `json:"cover_image_id"`
+}
+
+type albumImagesRequestBody struct {
+	ImageIDs []uint `json:"image_ids"`
+	// Index the images are inserted at, they are appended when omitted
+	Position *int `json:"position"`
+}
+
+// HandleList returns the caller's albums sorted by name
+func (h *AlbumsHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+
+	var albums []models.Album
+	if err := h.app.DB.Where("user_id = ?", userID).Order("name").Order("id").Find(&albums).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts, err := albumImageCounts(h.app.DB, albums)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]AlbumResponse, 0, len(albums))
+	for i := range albums {
+		response = append(response, newAlbumResponse(&albums[i], counts[albums[i].ID], h.app))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]AlbumResponse{"albums": response})
+}
+
+func (h *AlbumsHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	var body albumRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Name == nil {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	name, err := validateAlbumName(*body.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.CoverImageID != nil && *body.CoverImageID != 0 {
+		http.Error(w, "the cover must be an image of the album, add images first", http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	album := models.Album{UserID: userID, Name: name}
+	if err := h.app.DB.Create(&album).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("%s/albums/%d", h.app.Config.PublicURL, album.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAlbumResponse(&album, 0, h.app))
+}
+
+func (h *AlbumsHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+	h.writeAlbum(w, album)
+}
+
+// HandleUpdate renames the album or changes its cover
+func (h *AlbumsHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	var body albumRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	if body.Name != nil {
+		if album.Name, err = validateAlbumName(*body.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.CoverImageID != nil {
+		album.CoverImageID = nil
+		if *body.CoverImageID != 0 {
+			var count int64
+			err := h.app.DB.Model(&models.AlbumImage{}).
+				Where("album_id = ? AND image_metadata_id = ?", album.ID, *body.CoverImageID).
+				Count(&count).Error
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if count == 0 {
+				http.Error(w, "the cover must be an image of the album", http.StatusBadRequest)
+				return
+			}
+			album.CoverImageID = body.CoverImageID
+		}
+	}
+
+	if err := h.app.DB.Save(album).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.writeAlbum(w, album)
+}
+
+// HandleDelete removes the album, its images are kept
+func (h *AlbumsHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("album_id = ?", album.ID).Delete(&models.AlbumImage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(album).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"success": "true", "message": "Album deleted", "id": r.PathValue("id")})
+}
+
+// HandleListImages returns the images of the album in order, a page at a
+// time
+func (h *AlbumsHandler) HandleListImages(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	db := h.app.DB.Where("album_id = ?", album.ID)
+	if value := query.Get("cursor"); value != "" {
+		position, err := decodeAlbumCursor(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		db = db.Where("position > ?", position)
+	}
+
+	var members []models.AlbumImage
+	// One extra row is fetched to know whether there is a next page
+	if err := db.Order("position").Limit(limit + 1).Find(&members).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := ListImagesResponse{Images: make([]ImageResponse, 0, len(members))}
+	if len(members) > limit {
+		members = members[:limit]
+		response.NextCursor = encodeAlbumCursor(members[len(members)-1].Position)
+	}
+
+	ids := make([]uint, len(members))
+	for i, member := range members {
+		ids[i] = member.ImageMetadataID
+	}
+	var images []models.ImageMetadata
+	if err := preloadImageFields(h.app.DB).Where("id IN ?", ids).Find(&images).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[uint]*models.ImageMetadata, len(images))
+	for i := range images {
+		byID[images[i].ID] = &images[i]
+	}
+	for _, id := range ids {
+		if image, ok := byID[id]; ok {
+			response.Images = append(response.Images, newImageResponse(image, h.app))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleAddImages inserts images into the album. Images that are already
+// in it are moved to the new position.
+func (h *AlbumsHandler) HandleAddImages(w http.ResponseWriter, r *http.Request) {
+	h.changeImages(w, r, func(current []uint, body *albumImagesRequestBody) ([]uint, error) {
+		adding := make(map[uint]bool, len(body.ImageIDs))
+		for _, id := range body.ImageIDs {
+			adding[id] = true
+		}
+		kept := make([]uint, 0, len(current))
+		for _, id := range current {
+			if !adding[id] {
+				kept = append(kept, id)
+			}
+		}
+
+		position := len(kept)
+		if body.Position != nil {
+			if *body.Position < 0 {
+				return nil, stderrors.New("position must not be negative")
+			}
+			position = min(*body.Position, len(kept))
+		}
+		ids := append([]uint{}, kept[:position]...)
+		ids = append(ids, body.ImageIDs...)
+		return append(ids, kept[position:]...), nil
+	})
+}
+
+// HandleSetImages replaces the images of the album, in the given order
+func (h *AlbumsHandler) HandleSetImages(w http.ResponseWriter, r *http.Request) {
+	h.changeImages(w, r, func(current []uint, body *albumImagesRequestBody) ([]uint, error) {
+		if body.Position != nil {
+			return nil, stderrors.New("position can't be used when replacing the images")
+		}
+		return body.ImageIDs, nil
+	})
+}
+
+func (h *AlbumsHandler) HandleRemoveImage(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+	imageID, err := strconv.ParseUint(r.PathValue("imageID"), 10, 64)
+	if err != nil {
+		http.Error(w, errors.ErrInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("album_id = ? AND image_metadata_id = ?", album.ID, imageID).Delete(&models.AlbumImage{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.ErrImageNotFound
+		}
+		if album.CoverImageID != nil && uint64(*album.CoverImageID) == imageID {
+			album.CoverImageID = nil
+		}
+		// Saving also bumps the update time of the album
+		return tx.Save(album).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+	h.writeAlbum(w, album)
+}
+
+// changeImages validates the request and stores the membership computed
+// by change from the current images of the album
+func (h *AlbumsHandler) changeImages(w http.ResponseWriter, r *http.Request, change func(current []uint, body *albumImagesRequestBody) ([]uint, error)) {
+	var body albumImagesRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	album, err := findOwnAlbum(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkImageIDs(tx, body.ImageIDs, userID); err != nil {
+			return err
+		}
+
+		var current []uint
+		err := tx.Model(&models.AlbumImage{}).Where("album_id = ?", album.ID).
+			Order("position").Pluck("image_metadata_id", &current).Error
+		if err != nil {
+			return err
+		}
+
+		ids, err := change(current, &body)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidAlbumChange, err)
+		}
+		if len(ids) > maxAlbumSize {
+			return fmt.Errorf("%w: an album can have at most %d images", errInvalidAlbumChange, maxAlbumSize)
+		}
+		return setAlbumImages(tx, album, ids)
+	})
+	if err != nil {
+		if stderrors.Is(err, errInvalidAlbumChange) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.writeAlbum(w, album)
+}
+
+// Wraps the errors of changes to album images caused by the request
+var errInvalidAlbumChange = stderrors.New("invalid album images")
+
+func (h *AlbumsHandler) writeAlbum(w http.ResponseWriter, album *models.Album) {
+	counts, err := albumImageCounts(h.app.DB, []models.Album{*album})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAlbumResponse(album, counts[album.ID], h.app))
+}
+
+// setAlbumImages rewrites the membership of the album so positions follow
+// the order of ids. The cover is removed when its image leaves the album.
+func setAlbumImages(tx *gorm.DB, album *models.Album, ids []uint) error {
+	if err := tx.Where("album_id = ?", album.ID).Delete(&models.AlbumImage{}).Error; err != nil {
+		return err
+	}
+
+	members := make([]models.AlbumImage, len(ids))
+	coverKept := false
+	for i, id := range ids {
+		members[i] = models.AlbumImage{AlbumID: album.ID, ImageMetadataID: id, Position: i}
+		coverKept = coverKept || (album.CoverImageID != nil && *album.CoverImageID == id)
+	}
+	if len(members) > 0 {
+		if err := tx.CreateInBatches(members, 500).Error; err != nil {
+			return err
+		}
+	}
+
+	if !coverKept {
+		album.CoverImageID = nil
+	}
+	return tx.Save(album).Error
+}
+
+// removeFromAlbums takes a deleted image out of every album
+func removeFromAlbums(tx *gorm.DB, imageID uint) error {
+	if err := tx.Where("image_metadata_id = ?", imageID).Delete(&models.AlbumImage{}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Album{}).Where("cover_image_id = ?", imageID).Update("cover_image_id", nil).Error
+}
+
+// checkImageIDs makes sure the ids are distinct images owned by the user
+func checkImageIDs(db *gorm.DB, ids []uint, userID uint) error {
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("%w: image %d is listed more than once", errInvalidAlbumChange, id)
+		}
+		seen[id] = true
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var owned []uint
+	err := db.Model(&models.ImageMetadata{}).Where("id IN ? AND user_id = ?", ids, userID).Pluck("id", &owned).Error
+	if err != nil {
+		return err
+	}
+	if len(owned) == len(ids) {
+		return nil
+	}
+
+	found := make(map[uint]bool, len(owned))
+	for _, id := range owned {
+		found[id] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			return fmt.Errorf("%w: %w: %d", errInvalidAlbumChange, errors.ErrImageNotFound, id)
+		}
+	}
+	return nil
+}
+
+func findOwnAlbum(db *gorm.DB, id string, userID uint) (*models.Album, error) {
+	var album models.Album
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&album).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.ErrAlbumNotFound
+		}
+		return nil, err
+	}
+	return &album, nil
+}
+
+func albumImageCounts(db *gorm.DB, albums []models.Album) (map[uint]int64, error) {
+	ids := make([]uint, len(albums))
+	for i, album := range albums {
+		ids[i] = album.ID
+	}
+
+	var rows []struct {
+		AlbumID uint
+		Count   int64
+	}
+	counts := make(map[uint]int64, len(albums))
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	err := db.Model(&models.AlbumImage{}).Select("album_id, COUNT(*) AS count").
+		Where("album_id IN ?", ids).Group("album_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.AlbumID] = row.Count
+	}
+	return counts, nil
+}
+
+func validateAlbumName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxAlbumName {
+		return "", fmt.Errorf("album name must be between 1 and %d characters", maxAlbumName)
+	}
+	return name, nil
+}
+
+func encodeAlbumCursor(position int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(position)))
+}
+
+func decodeAlbumCursor(value string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	position, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return position, nil
+}
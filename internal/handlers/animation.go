@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/imaging"
+	"github.com/zafchiel/image-service/internal/models"
+)
+
+const frameParam = "frame"
+
+const (
+	// All frames of an animation are kept, the default
+	allFrames = -1
+	// The most detailed frame is picked as a still
+	posterFrame = -2
+)
+
+// Number of frames compared when picking a poster frame
+const posterCandidates = 10
+
+// parseFrame reads the frame query parameter, a zero based frame number
+// or "poster"
+func parseFrame(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return allFrames, nil
+	case "poster":
+		return posterFrame, nil
+	}
+	frame, err := strconv.Atoi(value)
+	if err != nil || frame < 0 {
+		return 0, fmt.Errorf("%w: %s", errors.ErrInvalidFrame, value)
+	}
+	return frame, nil
+}
+
+// loadAnimation decodes every frame of a stored GIF composited onto the
+// full canvas, so each one can be transformed on its own. The frame count
+// stored on upload is checked first, decoding allocates every frame.
+func (h *GetImageHandler) loadAnimation(imageMetadata *models.ImageMetadata) (*gif.GIF, []*image.RGBA, error) {
+	if err := checkFrameLimits(imageMetadata.FrameCount, imageMetadata.Width, imageMetadata.Height, h.app.Config); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := h.app.Storage.Open(imageMetadata.Filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	if err := checkImageLimits(file, h.app.Config); err != nil {
+		return nil, nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	anim, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return anim, imaging.Coalesce(anim), nil
+}
+
+// selectFrame picks a single frame of an animation, the first one when
+// all frames were requested
+func selectFrame(frames []*image.RGBA, frame int) (image.Image, error) {
+	switch {
+	case frame == allFrames:
+		return frames[0], nil
+	case frame == posterFrame:
+		return posterOf(frames), nil
+	case frame >= len(frames):
+		return nil, fmt.Errorf("%w: the image has %d frames", errors.ErrInvalidFrame, len(frames))
+	}
+	return frames[frame], nil
+}
+
+// posterOf returns the most detailed of evenly spaced frames, which skips
+// the blank or faded frames animations often start with
+func posterOf(frames []*image.RGBA) image.Image {
+	step := max(1, len(frames)/posterCandidates)
+	best, bestScore := frames[0], -1.0
+	for i := 0; i < len(frames); i += step {
+		if score := entropyScore(frames[i], frames[i].Bounds()); score > bestScore {
+			best, bestScore = frames[i], score
+		}
+	}
+	return best
+}
+
+// applyToFrames runs the pipeline on every frame of an animation
+func applyToFrames(pipeline Pipeline, frames []*image.RGBA) ([]image.Image, error) {
+	transformed := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		img, err := pipeline.Apply(frame)
+		if err != nil {
+			return nil, err
+		}
+		transformed[i] = img
+	}
+	return transformed, nil
+}
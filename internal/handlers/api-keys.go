@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/jwt"
+	"github.com/zafchiel/image-service/internal/middleware"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
+)
+
+const (
+	// Marks API keys among bearer tokens
+	apiKeyPrefix = "isk_"
+	// Characters of the key kept to identify it, including apiKeyPrefix
+	apiKeyPrefixLength = 12
+	maxAPIKeyName      = 100
+	// last_used_at is written at most this often per key
+	apiKeyUsageResolution = time.Minute
+)
+
+type APIKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// The key itself, only returned when it's created
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key *models.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Split(key.Scopes, ","),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+type APIKeysHandler struct {
+	app *App
+}
+
+func NewAPIKeysHandler(app *App) *APIKeysHandler {
+	return &APIKeysHandler{app: app}
+}
+
+type apiKeyRequestBody struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Lifetime of the key in seconds, 0 means it never expires
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// HandleList returns the caller's keys, newest first, including revoked
+// and expired ones
+func (h *APIKeysHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	userID, _ := session.UserID(r)
+
+	var keys []models.APIKey
+	if err := h.app.DB.Where("user_id = ?", userID).Order("id DESC").Find(&keys).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]APIKeyResponse, 0, len(keys))
+	for i := range keys {
+		response = append(response, newAPIKeyResponse(&keys[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]APIKeyResponse{"api_keys": response})
+}
+
+func (h *APIKeysHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	var body apiKeyRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxAPIKeyName {
+		http.Error(w, fmt.Sprintf("name must be between 1 and %d characters", maxAPIKeyName), http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(body.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.ExpiresIn < 0 {
+		http.Error(w, "expires_in must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	// 128 random bits
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret := apiKeyPrefix + id
+
+	userID, _ := session.UserID(r)
+	key := models.APIKey{
+		UserID: userID,
+		Name:   name,
+		Prefix: secret[:apiKeyPrefixLength],
+		Hash:   hashToken(secret),
+		Scopes: strings.Join(scopes, ","),
+	}
+	if body.ExpiresIn > 0 {
+		expires := time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+		key.ExpiresAt = &expires
+	}
+	if err := h.app.DB.Create(&key).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := newAPIKeyResponse(&key)
+	response.Key = secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleRevoke disables a key for good, it stays listed
+func (h *APIKeysHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	userID, _ := session.UserID(r)
+
+	var key models.APIKey
+	if err := h.app.DB.Where("id = ? AND user_id = ?", r.PathValue("id"), userID).First(&key).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, errors.ErrAPIKeyNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		if err := h.app.DB.Model(&key).Update("revoked_at", now).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAPIKeyResponse(&key))
+}
+
+// requireSession keeps scoped credentials from managing keys, which would
+// let a key grant itself more scopes
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if session.Scoped(r) {
+		http.Error(w, "API keys can't be managed with an API key", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func parseScopes(values []string) ([]string, error) {
+	scopes := make([]string, 0, len(values))
+	seen := make(map[string]bool)
+	for _, value := range values {
+		scope, ok := models.ParseScope(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s, use any of the following: %v", errors.ErrInvalidScope, value, models.Scopes)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required: %v", models.Scopes)
+	}
+	return scopes, nil
+}
+
+// authenticateBearer resolves the bearer tokens accepted by the API
+func authenticateBearer(app *App) middleware.Authenticator {
+	return func(token string) (uint, []string, error) {
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			return authenticateAPIKey(app.DB, token)
+		}
+		if jwt.LooksLikeToken(token) {
+			// Access tokens act as the user, like the session cookie
+			userID, err := authenticateAccessToken(app, token)
+			return userID, nil, err
+		}
+		return 0, nil, errors.ErrInvalidAPIKey
+	}
+}
+
+func authenticateAPIKey(db *gorm.DB, token string) (uint, []string, error) {
+	var key models.APIKey
+	if err := db.Where("hash = ?", hashToken(token)).First(&key).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil, errors.ErrInvalidAPIKey
+		}
+		return 0, nil, err
+	}
+
+	now := time.Now()
+	if !key.Active(now) {
+		return 0, nil, errors.ErrInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyUsageResolution {
+		if err := db.Model(&key).UpdateColumn("last_used_at", now).Error; err != nil {
+			return 0, nil, err
+		}
+	}
+	return key.UserID, strings.Split(key.Scopes, ","), nil
+}
+
+// hashToken doesn't need a slow hash, API keys and refresh tokens are random
+// and long enough that they can't be guessed
+func hashToken(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,8 +5,11 @@ import (
 	"time"
 
 	"github.com/rs/cors"
+	"github.com/zafchiel/image-service/internal/cache"
 	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/fetch"
 	"github.com/zafchiel/image-service/internal/middleware"
+	"github.com/zafchiel/image-service/internal/models"
 	"github.com/zafchiel/image-service/internal/storage"
 	"gorm.io/gorm"
 )
@@ -15,31 +18,90 @@ type App struct {
 	DB      *gorm.DB
 	Config  *config.Config
 	Storage storage.Storage
+	Cache   cache.Cache
+	Presets map[string]*Preset
+	// Fetches images for uploads from remote URLs
+	Fetcher *fetch.Client
 }
 
 func CreateRouter(app *App) http.Handler {
 	router := http.NewServeMux()
 
-	router.HandleFunc("POST /upload", NewUploadHandler(app).Handle)
-	router.HandleFunc("GET /image/{id}", NewGetImageHandler(app).Handle)
-	router.HandleFunc("DELETE /image/{id}", NewDeleteImageHandler(app).Handle)
+	// API key requests are limited to the scopes of the key
+	read := scoped(models.ScopeImagesRead)
+	write := scoped(models.ScopeImagesWrite)
+	remove := scoped(models.ScopeImagesDelete)
+
+	router.Handle("POST /upload", write(NewUploadHandler(app).Handle))
+	router.Handle("POST /upload/url", write(NewUploadURLHandler(app).Handle))
+	resumableUploadHandler := NewResumableUploadHandler(app)
+	router.HandleFunc("OPTIONS /uploads", resumableUploadHandler.HandleOptions)
+	router.Handle("POST /uploads", write(tusResumable(resumableUploadHandler.HandleCreate)))
+	router.Handle("HEAD /uploads/{id}", write(tusResumable(resumableUploadHandler.HandleHead)))
+	router.Handle("PATCH /uploads/{id}", write(tusResumable(resumableUploadHandler.HandlePatch)))
+	router.Handle("DELETE /uploads/{id}", write(tusResumable(resumableUploadHandler.HandleDelete)))
+	getImageHandler := NewGetImageHandler(app)
+	router.Handle("GET /image/{id}", read(getImageHandler.Handle))
+	router.Handle("GET /image/{id}/{preset}", read(getImageHandler.Handle))
+	router.Handle("GET /image/{id}/meta", read(NewGetImageMetaHandler(app).Handle))
+	router.Handle("DELETE /image/{id}", middleware.AuthGuard(remove(NewDeleteImageHandler(app).Handle)))
+	router.Handle("PATCH /image/{id}", middleware.AuthGuard(write(NewUpdateImageHandler(app).Handle)))
+	router.Handle("GET /images", middleware.AuthGuard(read(NewListImagesHandler(app).Handle)))
+	router.Handle("POST /sign", middleware.AuthGuard(read(NewSignURLHandler(app).Handle)))
+
+	albumsHandler := NewAlbumsHandler(app)
+	router.Handle("GET /albums", middleware.AuthGuard(read(albumsHandler.HandleList)))
+	router.Handle("POST /albums", middleware.AuthGuard(write(albumsHandler.HandleCreate)))
+	router.Handle("GET /albums/{id}", middleware.AuthGuard(read(albumsHandler.HandleGet)))
+	router.Handle("PATCH /albums/{id}", middleware.AuthGuard(write(albumsHandler.HandleUpdate)))
+	router.Handle("DELETE /albums/{id}", middleware.AuthGuard(write(albumsHandler.HandleDelete)))
+	router.Handle("GET /albums/{id}/images", middleware.AuthGuard(read(albumsHandler.HandleListImages)))
+	router.Handle("POST /albums/{id}/images", middleware.AuthGuard(write(albumsHandler.HandleAddImages)))
+	router.Handle("PUT /albums/{id}/images", middleware.AuthGuard(write(albumsHandler.HandleSetImages)))
+	router.Handle("DELETE /albums/{id}/images/{imageID}", middleware.AuthGuard(write(albumsHandler.HandleRemoveImage)))
+
+	tagsHandler := NewTagsHandler(app)
+	router.Handle("GET /tags", middleware.AuthGuard(read(tagsHandler.HandleList)))
+	router.Handle("PATCH /tags/{name}", middleware.AuthGuard(write(tagsHandler.HandleRename)))
+	router.Handle("DELETE /tags/{name}", middleware.AuthGuard(write(tagsHandler.HandleDelete)))
+	router.Handle("POST /image/{id}/tags", middleware.AuthGuard(write(tagsHandler.HandleAddToImage)))
+	router.Handle("DELETE /image/{id}/tags/{tag}", middleware.AuthGuard(write(tagsHandler.HandleRemoveFromImage)))
+
+	apiKeysHandler := NewAPIKeysHandler(app)
+	router.Handle("GET /api-keys", middleware.AuthGuard(http.HandlerFunc(apiKeysHandler.HandleList)))
+	router.Handle("POST /api-keys", middleware.AuthGuard(http.HandlerFunc(apiKeysHandler.HandleCreate)))
+	router.Handle("DELETE /api-keys/{id}", middleware.AuthGuard(http.HandlerFunc(apiKeysHandler.HandleRevoke)))
 
 	router.HandleFunc("POST /register", NewRegisterHandler(app).Handle)
 	router.HandleFunc("POST /login", NewLoginHandler(app).Handle)
+	tokenHandler := NewTokenHandler(app)
+	router.HandleFunc("POST /token", tokenHandler.Handle)
+	router.HandleFunc("POST /token/revoke", tokenHandler.HandleRevoke)
 
 	router.Handle("GET /docs/", http.StripPrefix("/docs/", http.FileServer(http.Dir("docs"))))
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "DELETE"},
-		AllowedHeaders: []string{"Content-Type"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset"},
+		ExposedHeaders: []string{
+			"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+			"Upload-Offset", "Upload-Length", "Upload-Expires", "Image-ID", "Image-URL",
+		},
 	})
 
 	mdStack := middleware.Stack(
 		middleware.Logger,
 		middleware.NewRateLimiter(10, time.Second*10).Limit,
 		corsHandler.Handler,
+		middleware.BearerAuth(authenticateBearer(app)),
 	)
 
 	return mdStack(router)
 }
+
+func scoped(scope string) func(http.HandlerFunc) http.Handler {
+	return func(next http.HandlerFunc) http.Handler {
+		return middleware.RequireScope(scope, next)
+	}
+}
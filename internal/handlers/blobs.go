@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"io/fs"
+	"log"
+
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Blobs are changed in the same transaction as the images referencing
+// them. A blob is only referenced again while its count is above zero, so
+// an upload can't reuse a blob whose last image is being deleted. Files
+// are deleted once that transaction commits, and a blob created again for
+// the same content gets a new filename, so deleting the old file can't
+// remove it. New content is moved back to its temporary file when the
+// transaction doesn't commit, so no file is left without a blob.
+
+var (
+	// Returned by acquireBlob when the blob was released concurrently, the
+	// transaction can be retried to create it again
+	errBlobReleased = stderrors.New("blob was released concurrently")
+	// Returned by acquireBlob when another upload created the blob for the
+	// same content first, the transaction can be retried to reuse it
+	errBlobCreated = stderrors.New("blob was created concurrently")
+)
+
+// Number of times an upload tries to reference its blob
+const maxBlobAttempts = 3
+
+// isBlobConflict reports whether a transaction failed because another one
+// changed the blob it used at the same time, so it can be retried
+func isBlobConflict(err error) bool {
+	return stderrors.Is(err, errBlobReleased) || stderrors.Is(err, errBlobCreated)
+}
+
+// acquireBlob adds a reference to the blob with the given content. New
+// content is moved from the temporary file to its content addressed name,
+// created reports that, so restoreBlobFile can undo it when the
+// transaction doesn't commit.
+func acquireBlob(tx *gorm.DB, store storage.Storage, tempName, hash, format string) (blob *models.Blob, created bool, err error) {
+	blob = &models.Blob{}
+	err = tx.Where("hash = ?", hash).First(blob).Error
+	if err == nil {
+		result := tx.Model(blob).Where("ref_count > 0").Update("ref_count", gorm.Expr("ref_count + 1"))
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, false, errBlobReleased
+		}
+		blob.RefCount++
+		return blob, false, nil
+	}
+	if !stderrors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	suffix, err := randomID()
+	if err != nil {
+		return nil, false, err
+	}
+	filename := hash + "-" + suffix[:8] + "." + format
+	if err := store.Move(tempName, filename); err != nil {
+		return nil, false, err
+	}
+	info, err := store.Stat(filename)
+	if err != nil {
+		restoreBlobFile(store, filename, tempName)
+		return nil, false, err
+	}
+
+	blob = &models.Blob{Hash: hash, Filename: filename, Format: format, Size: info.Size, RefCount: 1}
+	// The hash is unique, an upload of the same content that committed
+	// since the lookup above makes the insert a no-op
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(blob)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = errBlobCreated
+	}
+	if result.Error != nil {
+		restoreBlobFile(store, filename, tempName)
+		return nil, false, result.Error
+	}
+	return blob, true, nil
+}
+
+// restoreBlobFile moves the file of a blob that wasn't committed back to
+// its temporary name, where the upload deletes it or a retry moves it
+// again
+func restoreBlobFile(store storage.Storage, filename, tempName string) {
+	if err := store.Move(filename, tempName); err != nil {
+		log.Println("failed to restore blob file:", err)
+	}
+}
+
+// releaseBlob drops a reference to the blob. With the last one the blob is
+// deleted and its filename returned, for deleteBlobFile to remove once the
+// transaction committed.
+func releaseBlob(tx *gorm.DB, blobID uint) (string, error) {
+	var blob models.Blob
+	if err := tx.First(&blob, blobID).Error; err != nil {
+		return "", err
+	}
+
+	if err := tx.Model(&blob).Update("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		return "", err
+	}
+	result := tx.Where("id = ? AND ref_count <= 0", blob.ID).Delete(&models.Blob{})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", nil
+	}
+	return blob.Filename, nil
+}
+
+// deleteBlobFile removes the file of a released blob. The blob is already
+// gone, so a failure only leaves an unused file behind.
+func deleteBlobFile(store storage.Storage, filename string) {
+	if filename == "" {
+		return
+	}
+	if err := store.Delete(filename); err != nil && !stderrors.Is(err, fs.ErrNotExist) {
+		log.Println("failed to delete blob file:", err)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/storage"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	dir := t.TempDir()
+
+	// Opened like the server does
+	dsn := filepath.Join(dir, "test.db") + "?_txlock=immediate"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.ImageMetadata{}, &models.User{}, &models.Tag{}, &models.ImageDetails{}, &models.ImageProperty{}, &models.Album{}, &models.AlbumImage{}, &models.Blob{}); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+
+	cfg := config.Load()
+	cfg.StoragePath = filepath.Join(dir, "assets")
+	return &App{DB: db, Config: cfg, Storage: storage.NewLocalStorage(cfg.StoragePath)}
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// slowMove keeps the transaction that creates a blob open for a while, so
+// the other uploads run at the same time
+type slowMove struct {
+	storage.Storage
+}
+
+func (s slowMove) Move(src, dst string) error {
+	time.Sleep(50 * time.Millisecond)
+	return s.Storage.Move(src, dst)
+}
+
+func TestConcurrentUploadsShareBlob(t *testing.T) {
+	app := newTestApp(t)
+	app.Storage = slowMove{app.Storage}
+	content := encodePNG(t, 40, 30)
+
+	responses := make([]*UploadResponse, 4)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opts := &uploadOptions{UserID: uint(i + 1), Visibility: models.VisibilityPublic}
+			response, err := processUploadedFile(bytes.NewReader(content), "image.png", "image/png", app, opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			responses[i] = response
+		}()
+	}
+	wg.Wait()
+
+	for i, response := range responses {
+		if response == nil || !response.Success {
+			t.Fatalf("upload %d = %+v, want success", i, response)
+		}
+	}
+
+	var blobs []models.Blob
+	if err := app.DB.Find(&blobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 || blobs[0].RefCount != int64(len(responses)) {
+		t.Fatalf("blobs = %+v, want one blob with %d references", blobs, len(responses))
+	}
+
+	// Only the blob's file is left, no upload left a file behind
+	var files []string
+	filepath.WalkDir(app.Config.StoragePath, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files = append(files, filepath.Base(path))
+		}
+		return err
+	})
+	if len(files) != 1 || files[0] != blobs[0].Filename {
+		t.Errorf("stored files = %v, want only %s", files, blobs[0].Filename)
+	}
+}
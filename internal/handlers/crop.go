@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravityNorthEast Gravity = "northeast"
+	GravityEast      Gravity = "east"
+	GravitySouthEast Gravity = "southeast"
+	GravitySouth     Gravity = "south"
+	GravitySouthWest Gravity = "southwest"
+	GravityWest      Gravity = "west"
+	GravityNorthWest Gravity = "northwest"
+	// Keep the region with the most detail
+	GravityEntropy Gravity = "entropy"
+	// Keep the region most likely to draw the eye: edges, saturated colors
+	// and skin tones
+	GravityAttention Gravity = "attention"
+)
+
+var gravities = []Gravity{
+	GravityCenter, GravityNorth, GravityNorthEast, GravityEast, GravitySouthEast,
+	GravitySouth, GravitySouthWest, GravityWest, GravityNorthWest,
+	GravityEntropy, GravityAttention,
+}
+
+// Number of candidate windows compared by the entropy strategy
+const entropyCandidates = 25
+
+// CropOp cuts out Rect, clipped to the image bounds
+type CropOp struct{ Rect image.Rectangle }
+
+func (op CropOp) Apply(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	rect := op.Rect.Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return nil, fmt.Errorf("%w: crop is outside of the image", errors.ErrInvalidTransformation)
+	}
+	return transform.Crop(img, rect), nil
+}
+
+func (op CropOp) String() string {
+	return fmt.Sprintf("crop:%d,%d,%d,%d", op.Rect.Min.X, op.Rect.Min.Y, op.Rect.Dx(), op.Rect.Dy())
+}
+
+// parseCropOp parses x,y,w,h
+func parseCropOp(args string) (Operation, error) {
+	rect, err := parseCropRect(args)
+	if err != nil {
+		return nil, err
+	}
+	return CropOp{Rect: rect}, nil
+}
+
+func parseCropRect(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop must be x,y,w,h", errors.ErrInvalidTransformation)
+	}
+
+	values := make([]int, 4)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v < 0 {
+			return image.Rectangle{}, fmt.Errorf("%w: crop must be x,y,w,h", errors.ErrInvalidTransformation)
+		}
+		values[i] = v
+	}
+	if values[2] == 0 || values[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop width and height must be positive", errors.ErrInvalidTransformation)
+	}
+
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+func parseGravity(value string) (Gravity, error) {
+	for _, g := range gravities {
+		if string(g) == strings.ToLower(value) {
+			return g, nil
+		}
+	}
+	return "", fmt.Errorf("%w: gravity must be one of %v", errors.ErrInvalidTransformation, gravities)
+}
+
+// cropToGravity cuts a width x height window out of img, positioned
+// according to the gravity.
+func cropToGravity(img image.Image, width, height int, gravity Gravity) image.Image {
+	bounds := img.Bounds()
+	width = min(width, bounds.Dx())
+	height = min(height, bounds.Dy())
+	overflowX := bounds.Dx() - width
+	overflowY := bounds.Dy() - height
+
+	var x, y int
+	switch gravity {
+	case GravityEntropy:
+		x, y = bestWindow(img, width, height, entropyScore)
+	case GravityAttention:
+		x, y = bestWindow(img, width, height, attentionScore)
+	default:
+		x, y = overflowX/2, overflowY/2
+		if strings.Contains(string(gravity), "north") {
+			y = 0
+		}
+		if strings.Contains(string(gravity), "south") {
+			y = overflowY
+		}
+		if strings.Contains(string(gravity), "west") {
+			x = 0
+		}
+		if strings.Contains(string(gravity), "east") {
+			x = overflowX
+		}
+	}
+
+	origin := bounds.Min.Add(image.Pt(x, y))
+	return transform.Crop(img, image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))})
+}
+
+// bestWindow slides a width x height window along both axes and returns
+// the offset of the one with the highest score.
+func bestWindow(img image.Image, width, height int, score func(image.Image, image.Rectangle) float64) (int, int) {
+	bounds := img.Bounds()
+	overflowX := bounds.Dx() - width
+	overflowY := bounds.Dy() - height
+
+	bestX, bestY := overflowX/2, overflowY/2
+	bestScore := math.Inf(-1)
+	for _, y := range candidateOffsets(overflowY) {
+		for _, x := range candidateOffsets(overflowX) {
+			origin := bounds.Min.Add(image.Pt(x, y))
+			s := score(img, image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))})
+			if s > bestScore {
+				bestScore, bestX, bestY = s, x, y
+			}
+		}
+	}
+	return bestX, bestY
+}
+
+func candidateOffsets(overflow int) []int {
+	if overflow <= 0 {
+		return []int{0}
+	}
+	step := max(1, overflow/(entropyCandidates-1))
+	offsets := make([]int, 0, entropyCandidates)
+	for offset := 0; offset < overflow; offset += step {
+		offsets = append(offsets, offset)
+	}
+	return append(offsets, overflow)
+}
+
+// entropyScore is the Shannon entropy of the luminance histogram
+func entropyScore(img image.Image, rect image.Rectangle) float64 {
+	var histogram [256]int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			histogram[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+		}
+	}
+
+	total := float64(rect.Dx() * rect.Dy())
+	var entropy float64
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// attentionScore sums a per-pixel saliency estimate made of the local
+// luminance gradient, color saturation and a bonus for skin tones
+func attentionScore(img image.Image, rect image.Rectangle) float64 {
+	var total float64
+	for y := rect.Min.Y; y < rect.Max.Y-1; y++ {
+		for x := rect.Min.X; x < rect.Max.X-1; x++ {
+			r, g, b := rgb(img.At(x, y))
+			luma := 0.299*r + 0.587*g + 0.114*b
+
+			rightR, rightG, rightB := rgb(img.At(x+1, y))
+			belowR, belowG, belowB := rgb(img.At(x, y+1))
+			gradient := math.Abs(luma-(0.299*rightR+0.587*rightG+0.114*rightB)) +
+				math.Abs(luma-(0.299*belowR+0.587*belowG+0.114*belowB))
+
+			maxC := math.Max(r, math.Max(g, b))
+			minC := math.Min(r, math.Min(g, b))
+			saturation := 0.0
+			if maxC > 0 {
+				saturation = (maxC - minC) / maxC
+			}
+
+			skin := 0.0
+			if r > 0.37 && g > 0.16 && b > 0.08 && r > g && r > b && r-minC > 0.06 && math.Abs(r-g) > 0.06 {
+				skin = 1
+			}
+
+			total += gradient*4 + saturation + skin
+		}
+	}
+	return total
+}
+
+func rgb(c color.Color) (float64, float64, float64) {
+	r, g, b, _ := c.RGBA()
+	return float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff
+}
@@ -5,8 +5,8 @@ import (
 	"net/http"
 
 	"github.com/zafchiel/image-service/internal/errors"
-	"github.com/zafchiel/image-service/internal/models"
-	"gorm.io/gorm/clause"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
 )
 
 type DeleteImageHandler struct {
@@ -24,20 +24,34 @@ func (h *DeleteImageHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var imageMetadata models.ImageMetadata
-	result := h.app.DB.Clauses(clause.Returning{}).Delete(&imageMetadata, id)
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	userID, _ := session.UserID(r)
+
+	imageMetadata, err := findOwnImage(h.app.DB, id, userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
 		return
 	}
 
-	if result.RowsAffected == 0 {
-		http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+	// The file is shared by every image with the same content
+	var released string
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(imageMetadata).Error; err != nil {
+			return err
+		}
+		if err := removeFromAlbums(tx, imageMetadata.ID); err != nil {
+			return err
+		}
+		var err error
+		released, err = releaseBlob(tx, imageMetadata.BlobID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	deleteBlobFile(h.app.Storage, released)
 
-	err := h.app.Storage.Delete(imageMetadata.Filename)
-	if err != nil {
+	if err := h.app.Cache.Invalidate(imageMetadata.ID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
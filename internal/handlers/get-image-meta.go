@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+)
+
+type ImageMetaResponse struct {
+	ImageResponse
+	Width         int           `json:"width"`
+	Height        int           `json:"height"`
+	ColorModel    string        `json:"color_model"`
+	BitDepth      int           `json:"bit_depth"`
+	HasAlpha      bool          `json:"has_alpha"`
+	FrameCount    int           `json:"frame_count"`
+	DominantColor string        `json:"dominant_color"`
+	Exif          *ExifResponse `json:"exif,omitempty"`
+}
+
+type ExifResponse struct {
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	Orientation  int        `json:"orientation,omitempty"`
+	GPSLatitude  *float64   `json:"gps_latitude,omitempty"`
+	GPSLongitude *float64   `json:"gps_longitude,omitempty"`
+}
+
+type GetImageMetaHandler struct {
+	app *App
+}
+
+func NewGetImageMetaHandler(app *App) *GetImageMetaHandler {
+	return &GetImageMetaHandler{app: app}
+}
+
+func (h *GetImageMetaHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, errors.ErrInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var imageMetadata models.ImageMetadata
+	if err := preloadImageFields(h.app.DB).First(&imageMetadata, id).Error; err != nil {
+		http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	if !imageMetadata.CanView(userID) {
+		http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	response := ImageMetaResponse{
+		ImageResponse: newImageResponse(&imageMetadata, h.app),
+		Width:         imageMetadata.Width,
+		Height:        imageMetadata.Height,
+		ColorModel:    imageMetadata.ColorModel,
+		BitDepth:      imageMetadata.BitDepth,
+		HasAlpha:      imageMetadata.HasAlpha,
+		FrameCount:    imageMetadata.FrameCount,
+		DominantColor: imageMetadata.DominantColor,
+	}
+
+	// The orientation is kept by stripping, everything else would reveal
+	// what the served originals leave out
+	exif := ExifResponse{Orientation: imageMetadata.Orientation}
+	if !h.app.Config.StripMetadata {
+		exif.CameraMake = imageMetadata.CameraMake
+		exif.CameraModel = imageMetadata.CameraModel
+		exif.TakenAt = imageMetadata.TakenAt
+		exif.GPSLatitude = imageMetadata.GPSLatitude
+		exif.GPSLongitude = imageMetadata.GPSLongitude
+	}
+	if exif != (ExifResponse{}) {
+		response.Exif = &exif
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,19 +1,25 @@
 package handlers
 
 import (
+	"bytes"
+	stderrors "errors"
+	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/anthonynsimon/bild/adjust"
-	"github.com/anthonynsimon/bild/blur"
-	"github.com/anthonynsimon/bild/effect"
-	"github.com/anthonynsimon/bild/transform"
+	"github.com/zafchiel/image-service/internal/cache"
 	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/imaging"
 	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"github.com/zafchiel/image-service/internal/signing"
 )
 
 type ImageFormat string
@@ -24,7 +30,17 @@ const (
 	PNG  ImageFormat = "png"
 )
 
-var supportedFormats = []ImageFormat{JPG, JPEG, PNG}
+var supportedFormats = []ImageFormat{JPG, JPEG, PNG, GIF}
+
+// Query parameters that change how the output is encoded, sorted by name
+var encodingParams = []string{"compression", "q"}
+
+// variantParams lists every query parameter that selects the rendered
+// variant, which presets define on their own
+func variantParams() []string {
+	params := append([]string{"ops", "format", frameParam}, encodingParams...)
+	return append(params, flatTransformationParams...)
+}
 
 type GetImageHandler struct {
 	app *App
@@ -48,73 +64,297 @@ func (h *GetImageHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := h.app.Storage.Get(imageMetadata.Filename)
+	userID, _ := session.UserID(r)
+	if !imageMetadata.CanView(userID) {
+		http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	presetName := r.PathValue("preset")
+	if presetName == "" {
+		presetName = query.Get("preset")
+	}
+	if presetName != "" {
+		preset, ok := h.app.Presets[presetName]
+		if !ok {
+			http.Error(w, errors.ErrPresetNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		for _, name := range variantParams() {
+			if query.Has(name) {
+				http.Error(w, fmt.Sprintf("%s can't be combined with a preset", name), http.StatusBadRequest)
+				return
+			}
+		}
+		query = preset.Query()
+	}
+
+	frame, err := parseFrame(query.Get(frameParam))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	img, err := applyImageTransformations(image, r.URL.Query())
+	accept := r.Header.Get("Accept")
+	if imageMetadata.Animated() && frame == allFrames {
+		// WebP output is a still image, negotiating it would drop the animation
+		accept = ""
+	}
+	format, err := resolveOutputFormat(query.Get("format"), accept, imageMetadata.Format)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	encodeOpts, err := resolveEncodeOptions(query, h.app.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.EqualFold(query.Get("format"), "auto") {
+		w.Header().Add("Vary", "Accept")
+	}
 
-	w.Header().Set("Content-Type", "image/"+imageMetadata.Format)
-	if imageMetadata.Format == "png" {
-		png.Encode(w, img)
-	} else {
-		jpeg.Encode(w, img, nil)
+	pipeline, err := parsePipeline(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkOutputLimits(pipeline, h.app.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	spec := canonicalSpec(pipeline, frame, query)
+	transformed := spec != "" || format != normalizeFormat(ImageFormat(imageMetadata.Format))
+	if presetName == "" {
+		if transformed && h.app.Config.PresetsOnly {
+			http.Error(w, errors.ErrPresetRequired.Error(), http.StatusForbidden)
+			return
+		}
+		if err := h.verifySignature(r, transformed); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if !transformed {
+		h.serveOriginal(w, r, &imageMetadata)
+		return
 	}
+
+	cacheKey := cache.Key{ImageID: imageMetadata.ID, Spec: spec, Format: string(format)}
+	if entry, ok := h.app.Cache.Get(cacheKey); ok {
+		writeImage(w, entry)
+		return
+	}
+
+	entry, err := h.render(&imageMetadata, pipeline, frame, format, encodeOpts)
+	if err != nil {
+		switch {
+		case stderrors.Is(err, errors.ErrImageTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case stderrors.Is(err, errors.ErrOutputTooLarge):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case stderrors.Is(err, errors.ErrInvalidTransformation), stderrors.Is(err, errors.ErrInvalidFrame):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := h.app.Cache.Set(cacheKey, entry); err != nil {
+		log.Println("failed to cache image variant:", err)
+	}
+
+	writeImage(w, entry)
 }
 
-func applyImageTransformations(img image.Image, query url.Values) (image.Image, error) {
-	width, _ := strconv.Atoi(query.Get("w"))
-	height, _ := strconv.Atoi(query.Get("h"))
-	resized := img
+// render applies the pipeline to the stored image and encodes the result.
+// Animations keep all of their frames when the output is a GIF and no
+// single frame was requested.
+func (h *GetImageHandler) render(imageMetadata *models.ImageMetadata, pipeline Pipeline, frame int, format ImageFormat, opts *encodeOptions) (*cache.Entry, error) {
+	var buf bytes.Buffer
+	var img image.Image
 
-	if width == 0 || height == 0 {
-		resized = img
+	if imageMetadata.Animated() {
+		anim, frames, err := h.loadAnimation(imageMetadata)
+		if err != nil {
+			return nil, err
+		}
+		bounds := frames[0].Bounds()
+		if frame == allFrames && format == GIF {
+			if err := checkRenderLimits(pipeline, bounds.Dx(), bounds.Dy(), len(frames), h.app.Config); err != nil {
+				return nil, err
+			}
+			transformed, err := applyToFrames(pipeline, frames)
+			if err != nil {
+				return nil, err
+			}
+			if err := imaging.EncodeAnimation(&buf, transformed, anim.Delay, anim.LoopCount); err != nil {
+				return nil, err
+			}
+			return &cache.Entry{ContentType: contentTypeFor(string(format)), Data: buf.Bytes()}, nil
+		}
+		if img, err = selectFrame(frames, frame); err != nil {
+			return nil, err
+		}
 	} else {
-		resized = transform.Resize(img, width, height, transform.Linear)
+		if frame > 0 {
+			return nil, fmt.Errorf("%w: the image has 1 frame", errors.ErrInvalidFrame)
+		}
+		var err error
+		if img, err = h.loadImage(imageMetadata.Filename); err != nil {
+			return nil, err
+		}
 	}
 
-	// Apply other transformations
-	if blurRadius, err := strconv.ParseFloat(query.Get("blur"), 64); err == nil && blurRadius > 0 {
-		resized = blur.Gaussian(resized, blurRadius)
+	bounds := img.Bounds()
+	if err := checkRenderLimits(pipeline, bounds.Dx(), bounds.Dy(), 1, h.app.Config); err != nil {
+		return nil, err
+	}
+	img, err := pipeline.Apply(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := encodeImage(&buf, img, format, opts); err != nil {
+		return nil, err
 	}
+	return &cache.Entry{ContentType: contentTypeFor(string(format)), Data: buf.Bytes()}, nil
+}
 
-	if brightness, err := strconv.ParseFloat(query.Get("brightness"), 64); err == nil {
-		resized = adjust.Brightness(resized, brightness)
+// loadImage decodes a stored image after checking its dimensions, which
+// may predate the current limits
+func (h *GetImageHandler) loadImage(filename string) (image.Image, error) {
+	file, err := h.app.Storage.Open(filename)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	if contrast, err := strconv.ParseFloat(query.Get("contrast"), 64); err == nil {
-		resized = adjust.Contrast(resized, contrast)
+	if err := checkImageLimits(file, h.app.Config); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
 
-	if query.Get("grayscale") == "true" {
-		resized = effect.Grayscale(resized)
+	img, _, err := imaging.Decode(file)
+	return img, err
+}
+
+// verifySignature checks the URL signature when one is present, and
+// requires one for transformed output when the server is configured to
+func (h *GetImageHandler) verifySignature(r *http.Request, transformed bool) error {
+	query := r.URL.Query()
+	if !query.Has(signing.SignatureParam) {
+		if transformed && h.app.Config.RequireSignedURLs {
+			return errors.ErrSignatureRequired
+		}
+		return nil
+	}
+
+	if h.app.Config.URLSigningKey == "" {
+		return signing.ErrInvalidSignature
+	}
+	return signing.Verify([]byte(h.app.Config.URLSigningKey), r.URL.Path, query, time.Now())
+}
+
+// serveOriginal streams the stored bytes verbatim, with range and
+// conditional request support
+func (h *GetImageHandler) serveOriginal(w http.ResponseWriter, r *http.Request, imageMetadata *models.ImageMetadata) {
+	info, err := h.app.Storage.Stat(imageMetadata.Filename)
+	if err != nil {
+		if stderrors.Is(err, fs.ErrNotExist) {
+			http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if query.Get("sepia") == "true" {
-		resized = effect.Sepia(resized)
+	file, err := h.app.Storage.Open(imageMetadata.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	defer file.Close()
 
-	if query.Get("invert") == "true" {
-		resized = effect.Invert(resized)
+	content := io.ReadSeeker(file)
+	strip, err := h.stripMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strip {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if data, err = imaging.StripMetadata(data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
 	}
 
-	if rotation, err := strconv.ParseFloat(query.Get("rotate"), 64); err == nil {
-		resized = transform.Rotate(resized, rotation, nil)
+	w.Header().Set("Content-Type", contentTypeFor(imageMetadata.Format))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, imageMetadata.Filename, info.ModTime, content)
+}
+
+// stripMetadata reports whether metadata should be removed from a served
+// original. Transformed images never carry metadata since they are
+// re-encoded.
+func (h *GetImageHandler) stripMetadata(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("strip")
+	if value == "" {
+		return h.app.Config.StripMetadata, nil
 	}
+	strip, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid strip: %s", value)
+	}
+	// Metadata stripped by default can't be requested back
+	return strip || h.app.Config.StripMetadata, nil
+}
 
-	if query.Get("fliph") == "true" {
-		resized = transform.FlipH(resized)
+func contentTypeFor(format string) string {
+	if format == string(JPG) {
+		return "image/jpeg"
 	}
+	return "image/" + format
+}
 
-	if query.Get("flipv") == "true" {
-		resized = transform.FlipV(resized)
+func writeImage(w http.ResponseWriter, entry *cache.Entry) {
+	w.Header().Set("Content-Type", entry.ContentType)
+	// Browsers must not guess another type, whatever the bytes look like
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Data)))
+	w.Write(entry.Data)
+}
+
+// canonicalSpec describes everything that affects the rendered bytes
+// apart from the output format, so equivalent requests share a cache entry.
+func canonicalSpec(pipeline Pipeline, frame int, query url.Values) string {
+	params := make([]string, 0, len(encodingParams)+1)
+	switch frame {
+	case allFrames:
+	case posterFrame:
+		params = append(params, frameParam+"=poster")
+	default:
+		params = append(params, frameParam+"="+strconv.Itoa(frame))
+	}
+	for _, name := range encodingParams {
+		if value := query.Get(name); value != "" {
+			params = append(params, name+"="+url.QueryEscape(value))
+		}
 	}
 
-	return resized, nil
+	if len(pipeline) == 0 {
+		return strings.Join(params, "&")
+	}
+	return strings.Join(append([]string{"ops=" + pipeline.String()}, params...), "&")
 }
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limits of the fields clients can attach to an image
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxAltTextLength     = 1000
+	maxTags              = 20
+	maxTagLength         = 64
+	maxProperties        = 50
+	maxPropertyName      = 64
+)
+
+// imageFields are the descriptive fields of an image. Nil fields are left
+// unchanged, properties set to null are removed.
+type imageFields struct {
+	Title       *string                    `json:"title"`
+	Description *string                    `json:"description"`
+	AltText     *string                    `json:"alt_text"`
+	Tags        *[]string                  `json:"tags"`
+	Properties  map[string]json.RawMessage `json:"metadata"`
+}
+
+// set applies an upload form field and reports whether it is one of the
+// image fields
+func (f *imageFields) set(name, value string) (bool, error) {
+	switch name {
+	case "title":
+		f.Title = &value
+	case "description":
+		f.Description = &value
+	case "alt_text":
+		f.AltText = &value
+	case "tags":
+		// Either comma separated or one tag per field
+		tags := strings.Split(value, ",")
+		if f.Tags != nil {
+			tags = append(*f.Tags, tags...)
+		}
+		f.Tags = &tags
+	case "metadata":
+		var properties map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(value), &properties); err != nil {
+			return true, fmt.Errorf("invalid metadata, use a JSON object: %w", err)
+		}
+		if f.Properties == nil {
+			f.Properties = make(map[string]json.RawMessage)
+		}
+		for name, value := range properties {
+			f.Properties[name] = value
+		}
+	default:
+		return false, nil
+	}
+	return true, f.validate()
+}
+
+// validate checks the field limits and normalizes the tags
+func (f *imageFields) validate() error {
+	if f.Title != nil && utf8.RuneCountInString(*f.Title) > maxTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+	if f.Description != nil && utf8.RuneCountInString(*f.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	if f.AltText != nil && utf8.RuneCountInString(*f.AltText) > maxAltTextLength {
+		return fmt.Errorf("alt_text must be at most %d characters", maxAltTextLength)
+	}
+
+	if f.Tags != nil {
+		tags, err := normalizeTags(*f.Tags)
+		if err != nil {
+			return err
+		}
+		if len(tags) > maxTags {
+			return fmt.Errorf("an image can have at most %d tags", maxTags)
+		}
+		f.Tags = &tags
+	}
+
+	if len(f.Properties) > maxProperties {
+		return fmt.Errorf("%w, at most %d", errors.ErrTooManyProperties, maxProperties)
+	}
+	for name := range f.Properties {
+		if name == "" || utf8.RuneCountInString(name) > maxPropertyName {
+			return fmt.Errorf("metadata keys must be between 1 and %d characters", maxPropertyName)
+		}
+	}
+	return nil
+}
+
+// applyImageFields stores the fields of an already created image
+func applyImageFields(tx *gorm.DB, image *models.ImageMetadata, fields *imageFields) error {
+	if fields.Title != nil || fields.Description != nil || fields.AltText != nil {
+		details := models.ImageDetails{ImageMetadataID: image.ID}
+		if err := tx.Where(&details).FirstOrInit(&details).Error; err != nil {
+			return err
+		}
+		if fields.Title != nil {
+			details.Title = *fields.Title
+		}
+		if fields.Description != nil {
+			details.Description = *fields.Description
+		}
+		if fields.AltText != nil {
+			details.AltText = *fields.AltText
+		}
+		if err := tx.Save(&details).Error; err != nil {
+			return err
+		}
+	}
+
+	if fields.Tags != nil {
+		tags, err := findOrCreateTags(tx, image.UserID, *fields.Tags)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(image).Association("Tags").Replace(tags); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range fields.Properties {
+		property := models.ImageProperty{ImageMetadataID: image.ID, Name: name}
+		if string(value) == "null" {
+			if err := tx.Where(&property).Delete(&models.ImageProperty{}).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		property.Value = string(value)
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "image_metadata_id"}, {Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value"}),
+		}).Create(&property).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields.Properties) > 0 {
+		var count int64
+		if err := tx.Model(&models.ImageProperty{}).Where("image_metadata_id = ?", image.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		// Checked after merging, as the limit applies to the stored keys
+		if count > maxProperties {
+			return fmt.Errorf("%w, at most %d", errors.ErrTooManyProperties, maxProperties)
+		}
+	}
+
+	return nil
+}
+
+// normalizeTags trims the tag names and drops empty and repeated ones
+func normalizeTags(names []string) ([]string, error) {
+	tags := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, tag := range names {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters: %s", maxTagLength, tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// findOrCreateTags returns the user's tags with the given names, creating
+// the missing ones
+func findOrCreateTags(tx *gorm.DB, userID uint, names []string) ([]models.Tag, error) {
+	tags := make([]models.Tag, len(names))
+	for i, name := range names {
+		if err := tx.Where(models.Tag{Name: name, UserID: userID}).FirstOrCreate(&tags[i]).Error; err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/imaging"
+)
+
+// checkImageLimits reads only the image header, so oversized images are
+// rejected before decoding allocates memory for their pixels
+func checkImageLimits(r io.Reader, cfg *config.Config) error {
+	imageConfig, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+
+	width, height := imageConfig.Width, imageConfig.Height
+	if width > cfg.MaxImageDimension || height > cfg.MaxImageDimension || int64(width)*int64(height) > cfg.MaxImagePixels {
+		return fmt.Errorf("%w: %dx%d, the maximum is %d pixels and %d per side",
+			errors.ErrImageTooLarge, width, height, cfg.MaxImagePixels, cfg.MaxImageDimension)
+	}
+	return nil
+}
+
+// checkGIFLimits reads the frame count of a GIF without decoding it, so
+// animations with too many frames are rejected before their pixels are
+// allocated
+func checkGIFLimits(r io.Reader, cfg *config.Config) error {
+	info, err := imaging.ScanGIF(r)
+	if err != nil {
+		return err
+	}
+	return checkFrameLimits(info.Frames, info.Width, info.Height, cfg)
+}
+
+// checkFrameLimits bounds the pixels of all frames of an animation
+// together, as they are decoded at once
+func checkFrameLimits(frames, width, height int, cfg *config.Config) error {
+	if int64(frames)*int64(width)*int64(height) > cfg.MaxImagePixels {
+		return fmt.Errorf("%w: %d frames of %dx%d, the maximum is %d pixels across all frames",
+			errors.ErrImageTooLarge, frames, width, height, cfg.MaxImagePixels)
+	}
+	return nil
+}
+
+// checkOutputLimits caps the dimensions requested by resize operations.
+// It needs no source image, checkRenderLimits checks what resizing it
+// actually produces.
+func checkOutputLimits(pipeline Pipeline, cfg *config.Config) error {
+	for _, op := range pipeline {
+		resize, ok := op.(ResizeOp)
+		if !ok {
+			continue
+		}
+		if err := checkOutputSize(image.Pt(resize.Width, resize.Height), cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRenderLimits follows the dimensions of a width x height source
+// through the pipeline, since resizes that keep the aspect ratio can
+// produce far more pixels than the dimensions requested. All frames of an
+// animation are held in memory at once, so frames bounds their pixels
+// together.
+func checkRenderLimits(pipeline Pipeline, width, height, frames int, cfg *config.Config) error {
+	size := image.Pt(width, height)
+	for _, op := range pipeline {
+		switch op := op.(type) {
+		case CropOp:
+			size = op.Rect.Intersect(image.Rect(0, 0, size.X, size.Y)).Size()
+		case ResizeOp:
+			var resampled image.Point
+			resampled, size = op.sizes(size.X, size.Y)
+			if err := checkOutputSize(resampled, cfg); err != nil {
+				return err
+			}
+		}
+		if size.X <= 0 || size.Y <= 0 {
+			// The crop fails when the pipeline is applied
+			return nil
+		}
+	}
+
+	if int64(frames)*int64(size.X)*int64(size.Y) > cfg.MaxImagePixels {
+		return fmt.Errorf("%w: %d frames of %dx%d, the maximum is %d pixels across all frames",
+			errors.ErrOutputTooLarge, frames, size.X, size.Y, cfg.MaxImagePixels)
+	}
+	return nil
+}
+
+func checkOutputSize(size image.Point, cfg *config.Config) error {
+	if size.X > cfg.MaxOutputDimension || size.Y > cfg.MaxOutputDimension ||
+		int64(size.X)*int64(size.Y) > cfg.MaxImagePixels {
+		return fmt.Errorf("%w: %dx%d, the maximum is %d per side and %d pixels",
+			errors.ErrOutputTooLarge, size.X, size.Y, cfg.MaxOutputDimension, cfg.MaxImagePixels)
+	}
+	return nil
+}
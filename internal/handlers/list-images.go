@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type ImageResponse struct {
+	ID         uint              `json:"id"`
+	URL        string            `json:"url"`
+	Format     string            `json:"format"`
+	Size       int64             `json:"size"`
+	Visibility models.Visibility `json:"visibility"`
+	Tags       []string          `json:"tags"`
+	CreatedAt  time.Time         `json:"created_at"`
+
+	// Fields supplied by the uploader
+	Title       string                     `json:"title,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	AltText     string                     `json:"alt_text,omitempty"`
+	Metadata    map[string]json.RawMessage `json:"metadata,omitempty"`
+}
+
+type ListImagesResponse struct {
+	Images []ImageResponse `json:"images"`
+	// Pass as the cursor parameter to fetch the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func newImageResponse(image *models.ImageMetadata, app *App) ImageResponse {
+	tags := make([]string, len(image.Tags))
+	for i, tag := range image.Tags {
+		tags[i] = tag.Name
+	}
+
+	response := ImageResponse{
+		ID:         image.ID,
+		URL:        fmt.Sprintf("%s/image/%d", app.Config.PublicURL, image.ID),
+		Format:     image.Format,
+		Size:       image.Size,
+		Visibility: image.Visibility,
+		Tags:       tags,
+		CreatedAt:  image.CreatedAt,
+	}
+	if image.Details != nil {
+		response.Title = image.Details.Title
+		response.Description = image.Details.Description
+		response.AltText = image.Details.AltText
+	}
+	if len(image.Properties) > 0 {
+		response.Metadata = make(map[string]json.RawMessage, len(image.Properties))
+		for _, property := range image.Properties {
+			response.Metadata[property.Name] = json.RawMessage(property.Value)
+		}
+	}
+	return response
+}
+
+// preloadImageFields loads what newImageResponse needs besides the image
+func preloadImageFields(db *gorm.DB) *gorm.DB {
+	return db.Preload("Tags").Preload("Details").Preload("Properties")
+}
+
+type ListImagesHandler struct {
+	app *App
+}
+
+func NewListImagesHandler(app *App) *ListImagesHandler {
+	return &ListImagesHandler{app: app}
+}
+
+// listCursor is the position after the last image of a page. Value holds
+// the sort column of that image, ID breaks ties.
+type listCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+type listQuery struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	Cursor     *listCursor
+	// Cursor value converted to the type of the sort column
+	CursorValue   any
+	Format        string
+	Tag           string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func (h *ListImagesHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+
+	lq, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	images, err := h.findImages(userID, lq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := ListImagesResponse{Images: make([]ImageResponse, 0, len(images))}
+	// One extra row is fetched to know whether there is a next page
+	if len(images) > lq.Limit {
+		images = images[:lq.Limit]
+		response.NextCursor = encodeListCursor(&images[len(images)-1], lq.Sort)
+	}
+	for i := range images {
+		response.Images = append(response.Images, newImageResponse(&images[i], h.app))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *ListImagesHandler) findImages(userID uint, lq *listQuery) ([]models.ImageMetadata, error) {
+	column := "image_metadata.created_at"
+	if lq.Sort == "size" {
+		column = "image_metadata.size"
+	}
+	direction, comparison := "ASC", ">"
+	if lq.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	db := preloadImageFields(h.app.DB).Where("image_metadata.user_id = ?", userID)
+
+	if lq.Format != "" {
+		db = db.Where("image_metadata.format = ?", lq.Format)
+	}
+	if !lq.CreatedAfter.IsZero() {
+		db = db.Where("image_metadata.created_at >= ?", lq.CreatedAfter)
+	}
+	if !lq.CreatedBefore.IsZero() {
+		db = db.Where("image_metadata.created_at < ?", lq.CreatedBefore)
+	}
+	if lq.Tag != "" {
+		db = db.Joins("JOIN image_tags ON image_tags.image_metadata_id = image_metadata.id").
+			Joins("JOIN tags ON tags.id = image_tags.tag_id AND tags.deleted_at IS NULL").
+			Where("tags.name = ?", lq.Tag)
+	}
+
+	if lq.Cursor != nil {
+		db = db.Where(
+			fmt.Sprintf("%[1]s %[2]s ? OR (%[1]s = ? AND image_metadata.id %[2]s ?)", column, comparison),
+			lq.CursorValue, lq.CursorValue, lq.Cursor.ID,
+		)
+	}
+
+	var images []models.ImageMetadata
+	err := db.Order(column + " " + direction).
+		Order("image_metadata.id " + direction).
+		Limit(lq.Limit + 1).
+		Find(&images).Error
+	return images, err
+}
+
+func parseListQuery(query url.Values) (*listQuery, error) {
+	lq := &listQuery{
+		Sort:       "created",
+		Descending: true,
+		Limit:      defaultPageSize,
+		Format:     strings.ToLower(query.Get("format")),
+		Tag:        query.Get("tag"),
+	}
+
+	switch value := query.Get("sort"); value {
+	case "", "created":
+	case "size":
+		lq.Sort = value
+	default:
+		return nil, fmt.Errorf("invalid sort: %s, use created or size", value)
+	}
+
+	switch value := query.Get("order"); value {
+	case "", "desc":
+	case "asc":
+		lq.Descending = false
+	default:
+		return nil, fmt.Errorf("invalid order: %s, use asc or desc", value)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		lq.Limit = limit
+	}
+
+	var err error
+	if value := query.Get("cursor"); value != "" {
+		if lq.Cursor, err = decodeListCursor(value); err != nil {
+			return nil, err
+		}
+		if lq.CursorValue, err = cursorValue(lq.Cursor, lq.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	if lq.CreatedAfter, err = parseDateParam(query, "created_after"); err != nil {
+		return nil, err
+	}
+	if lq.CreatedBefore, err = parseDateParam(query, "created_before"); err != nil {
+		return nil, err
+	}
+
+	return lq, nil
+}
+
+// parseDateParam accepts RFC 3339 timestamps and plain YYYY-MM-DD dates
+func parseDateParam(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			// Timestamps are stored in local time and compared as text
+			return t.In(time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s: use RFC 3339 or YYYY-MM-DD", name)
+}
+
+func encodeListCursor(image *models.ImageMetadata, sort string) string {
+	cursor := listCursor{Value: image.CreatedAt.Format(time.RFC3339Nano), ID: image.ID}
+	if sort == "size" {
+		cursor.Value = strconv.FormatInt(image.Size, 10)
+	}
+
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(value string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+func cursorValue(cursor *listCursor, sort string) (any, error) {
+	if sort == "size" {
+		size, err := strconv.ParseInt(cursor.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		return size, nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, cursor.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return createdAt.In(time.Local), nil
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+const (
+	GIF  ImageFormat = "gif"
+	WEBP ImageFormat = "webp"
+)
+
+// Formats the service can encode responses in. AVIF is left out until a
+// pure Go encoder is available.
+var outputFormats = []ImageFormat{JPEG, PNG, GIF, WEBP}
+
+// resolveOutputFormat picks the response format from the requested one,
+// negotiating through the Accept header when it is "auto" and falling back
+// to the format the image was uploaded in.
+func resolveOutputFormat(requested, accept, original string) (ImageFormat, error) {
+	requested = strings.ToLower(requested)
+	switch requested {
+	case "":
+		return normalizeFormat(ImageFormat(original)), nil
+	case "auto":
+		// WebP output is lossless, which only beats the original when that
+		// is lossless too. JPEGs stay JPEGs and keep honouring q.
+		if !isLossy(original) && acceptsMediaType(accept, contentTypeFor(string(WEBP))) {
+			return WEBP, nil
+		}
+		return normalizeFormat(ImageFormat(original)), nil
+	}
+
+	format := normalizeFormat(ImageFormat(requested))
+	for _, f := range outputFormats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return "", errors.ErrUnsupportedOutputFormat
+}
+
+func normalizeFormat(format ImageFormat) ImageFormat {
+	if format == JPG {
+		return JPEG
+	}
+	return format
+}
+
+func isLossy(format string) bool {
+	return normalizeFormat(ImageFormat(format)) == JPEG
+}
+
+// acceptsMediaType reports whether the Accept header explicitly lists the
+// media type with a non-zero quality. Wildcards are ignored on purpose,
+// browsers send */* even when they can't render the format.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || accepted != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+type encodeOptions struct {
+	// Quality of lossy formats, currently only JPEG as WebP output is lossless
+	Quality     int
+	Compression png.CompressionLevel
+}
+
+// resolveEncodeOptions reads the q and compression query parameters,
+// falling back to the server defaults and clamping q to the configured
+// maximum.
+func resolveEncodeOptions(query url.Values, cfg *config.Config) (*encodeOptions, error) {
+	opts := &encodeOptions{Quality: cfg.DefaultQuality}
+
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, errors.ErrInvalidQuality
+		}
+		opts.Quality = quality
+	}
+	opts.Quality = min(opts.Quality, cfg.MaxQuality)
+
+	compression := query.Get("compression")
+	if compression == "" {
+		compression = cfg.PNGCompression
+	}
+	level, ok := pngCompressionLevels[strings.ToLower(compression)]
+	if !ok {
+		return nil, errors.ErrInvalidCompression
+	}
+	opts.Compression = level
+
+	return opts, nil
+}
+
+func encodeImage(w io.Writer, img image.Image, format ImageFormat, opts *encodeOptions) error {
+	switch format {
+	case PNG:
+		encoder := png.Encoder{CompressionLevel: opts.Compression}
+		return encoder.Encode(w, img)
+	case GIF:
+		return gif.Encode(w, img, nil)
+	case WEBP:
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
+	}
+}
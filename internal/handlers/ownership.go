@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"gorm.io/gorm"
+)
+
+// findOwnImage loads an image the user may modify. Private images of other
+// users are reported as not found, so their existence isn't revealed.
+func findOwnImage(db *gorm.DB, id string, userID uint) (*models.ImageMetadata, error) {
+	var imageMetadata models.ImageMetadata
+	if err := db.First(&imageMetadata, id).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.ErrImageNotFound
+		}
+		return nil, err
+	}
+
+	if imageMetadata.UserID != userID {
+		if !imageMetadata.CanView(userID) {
+			return nil, errors.ErrImageNotFound
+		}
+		return nil, errors.ErrNotImageOwner
+	}
+	return &imageMetadata, nil
+}
+
+// ownershipStatus maps the errors of findOwnImage and findOwnAlbum to
+// response codes
+func ownershipStatus(err error) int {
+	switch {
+	case stderrors.Is(err, errors.ErrImageNotFound), stderrors.Is(err, errors.ErrAlbumNotFound):
+		return http.StatusNotFound
+	case stderrors.Is(err, errors.ErrNotImageOwner):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
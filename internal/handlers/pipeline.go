@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/anthonynsimon/bild/adjust"
+	"github.com/anthonynsimon/bild/blur"
+	"github.com/anthonynsimon/bild/effect"
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+// Operation is a single step of a transformation pipeline
+type Operation interface {
+	Apply(img image.Image) (image.Image, error)
+	// String renders the operation in the ops syntax, e.g. "blur:2"
+	String() string
+}
+
+// Pipeline is an ordered list of operations, written in the ops query
+// parameter as operations separated by "|":
+//
+//	?ops=rotate:90|resize:300x200,fit=cover|blur:2
+type Pipeline []Operation
+
+func (p Pipeline) Apply(img image.Image) (image.Image, error) {
+	var err error
+	for _, op := range p {
+		img, err = op.Apply(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// String is the canonical form of the pipeline, equal pipelines render
+// the same regardless of how they were requested
+func (p Pipeline) String() string {
+	ops := make([]string, len(p))
+	for i, op := range p {
+		ops[i] = op.String()
+	}
+	return strings.Join(ops, "|")
+}
+
+// Flat query parameters kept as a shorthand for a fixed order pipeline
+var flatTransformationParams = []string{
+	"crop", "w", "h", "fit", "filter", "bg", "gravity", "blur", "brightness",
+	"contrast", "grayscale", "sepia", "invert", "rotate", "fliph", "flipv",
+}
+
+// The blur kernel grows with the radius, so the radius is capped to keep
+// the cost of a blur bounded
+const maxBlurRadius = 50
+
+type operationParser func(args string) (Operation, error)
+
+var operationParsers = map[string]operationParser{
+	"crop":       parseCropOp,
+	"resize":     parseResizeOp,
+	"blur":       floatOperationParser("blur", 0, maxBlurRadius, func(v float64) Operation { return BlurOp{Radius: v} }),
+	"brightness": floatOperationParser("brightness", -1, 1, func(v float64) Operation { return BrightnessOp{Change: v} }),
+	"contrast":   floatOperationParser("contrast", -1, 1, func(v float64) Operation { return ContrastOp{Change: v} }),
+	"rotate":     floatOperationParser("rotate", -360, 360, func(v float64) Operation { return RotateOp{Angle: v} }),
+	"grayscale":  flagOperationParser("grayscale", GrayscaleOp{}),
+	"sepia":      flagOperationParser("sepia", SepiaOp{}),
+	"invert":     flagOperationParser("invert", InvertOp{}),
+	"fliph":      flagOperationParser("fliph", FlipHOp{}),
+	"flipv":      flagOperationParser("flipv", FlipVOp{}),
+}
+
+// parsePipeline builds the pipeline from the ops parameter or, when it is
+// absent, from the flat query parameters
+func parsePipeline(query url.Values) (Pipeline, error) {
+	ops := query.Get("ops")
+	if ops == "" {
+		return pipelineFromFlatParams(query)
+	}
+
+	for _, name := range flatTransformationParams {
+		if query.Has(name) {
+			return nil, fmt.Errorf("%w: %s can't be combined with ops", errors.ErrInvalidTransformation, name)
+		}
+	}
+
+	return parseOps(ops)
+}
+
+func parseOps(value string) (Pipeline, error) {
+	var pipeline Pipeline
+	for _, step := range strings.Split(value, "|") {
+		name, args, _ := strings.Cut(strings.TrimSpace(step), ":")
+		parse, ok := operationParsers[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown operation %q", errors.ErrInvalidTransformation, name)
+		}
+
+		op, err := parse(args)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, op)
+	}
+	return pipeline, nil
+}
+
+func pipelineFromFlatParams(query url.Values) (Pipeline, error) {
+	var pipeline Pipeline
+
+	if value := query.Get("crop"); value != "" {
+		op, err := parseCropOp(value)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, op)
+	}
+
+	resizeOp, err := resizeOpFromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if resizeOp != nil {
+		pipeline = append(pipeline, resizeOp)
+	}
+
+	for _, name := range []string{"blur", "brightness", "contrast"} {
+		if value := query.Get(name); value != "" {
+			op, err := operationParsers[name](value)
+			if err != nil {
+				return nil, err
+			}
+			if blurOp, ok := op.(BlurOp); ok && blurOp.Radius <= 0 {
+				continue
+			}
+			pipeline = append(pipeline, op)
+		}
+	}
+
+	for _, name := range []string{"grayscale", "sepia", "invert"} {
+		if query.Get(name) == "true" {
+			op, _ := operationParsers[name]("")
+			pipeline = append(pipeline, op)
+		}
+	}
+
+	if value := query.Get("rotate"); value != "" {
+		op, err := operationParsers["rotate"](value)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, op)
+	}
+
+	for _, name := range []string{"fliph", "flipv"} {
+		if query.Get(name) == "true" {
+			op, _ := operationParsers[name]("")
+			pipeline = append(pipeline, op)
+		}
+	}
+
+	return pipeline, nil
+}
+
+// floatOperationParser parses a single number between min and max, NaN is
+// rejected explicitly as it fails no comparison
+func floatOperationParser(name string, min, max float64, build func(float64) Operation) operationParser {
+	return func(args string) (Operation, error) {
+		value, err := strconv.ParseFloat(args, 64)
+		if err != nil || math.IsNaN(value) {
+			return nil, fmt.Errorf("%w: %s requires a number", errors.ErrInvalidTransformation, name)
+		}
+		if value < min || value > max {
+			return nil, fmt.Errorf("%w: %s must be between %s and %s",
+				errors.ErrInvalidTransformation, name, formatFloat(min), formatFloat(max))
+		}
+		return build(value), nil
+	}
+}
+
+func flagOperationParser(name string, op Operation) operationParser {
+	return func(args string) (Operation, error) {
+		if args != "" {
+			return nil, fmt.Errorf("%w: %s takes no arguments", errors.ErrInvalidTransformation, name)
+		}
+		return op, nil
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+type BlurOp struct{ Radius float64 }
+
+func (op BlurOp) Apply(img image.Image) (image.Image, error) {
+	if op.Radius <= 0 {
+		return img, nil
+	}
+	return blur.Gaussian(img, op.Radius), nil
+}
+
+func (op BlurOp) String() string { return "blur:" + formatFloat(op.Radius) }
+
+type BrightnessOp struct{ Change float64 }
+
+func (op BrightnessOp) Apply(img image.Image) (image.Image, error) {
+	return adjust.Brightness(img, op.Change), nil
+}
+
+func (op BrightnessOp) String() string { return "brightness:" + formatFloat(op.Change) }
+
+type ContrastOp struct{ Change float64 }
+
+func (op ContrastOp) Apply(img image.Image) (image.Image, error) {
+	return adjust.Contrast(img, op.Change), nil
+}
+
+func (op ContrastOp) String() string { return "contrast:" + formatFloat(op.Change) }
+
+type RotateOp struct{ Angle float64 }
+
+func (op RotateOp) Apply(img image.Image) (image.Image, error) {
+	return transform.Rotate(img, op.Angle, nil), nil
+}
+
+func (op RotateOp) String() string { return "rotate:" + formatFloat(op.Angle) }
+
+type GrayscaleOp struct{}
+
+func (GrayscaleOp) Apply(img image.Image) (image.Image, error) { return effect.Grayscale(img), nil }
+
+func (GrayscaleOp) String() string { return "grayscale" }
+
+type SepiaOp struct{}
+
+func (SepiaOp) Apply(img image.Image) (image.Image, error) { return effect.Sepia(img), nil }
+
+func (SepiaOp) String() string { return "sepia" }
+
+type InvertOp struct{}
+
+func (InvertOp) Apply(img image.Image) (image.Image, error) { return effect.Invert(img), nil }
+
+func (InvertOp) String() string { return "invert" }
+
+type FlipHOp struct{}
+
+func (FlipHOp) Apply(img image.Image) (image.Image, error) { return transform.FlipH(img), nil }
+
+func (FlipHOp) String() string { return "fliph" }
+
+type FlipVOp struct{}
+
+func (FlipVOp) Apply(img image.Image) (image.Image, error) { return transform.FlipV(img), nil }
+
+func (FlipVOp) String() string { return "flipv" }
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"net/url"
+	"testing"
+
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+func TestParseOpsNumbers(t *testing.T) {
+	tests := []struct {
+		ops   string
+		valid bool
+	}{
+		{"blur:2", true},
+		{"blur:0", true},
+		{"blur:50", true},
+		{"blur:51", false},
+		{"blur:NaN", false},
+		{"blur:Inf", false},
+		{"blur:-Inf", false},
+		{"blur:1e6", false},
+		{"blur:1e400", false},
+		{"blur:-1", false},
+		{"brightness:-1", true},
+		{"brightness:0.5", true},
+		{"brightness:NaN", false},
+		{"brightness:1.5", false},
+		{"contrast:1", true},
+		{"contrast:+Inf", false},
+		{"contrast:-2", false},
+		{"rotate:90", true},
+		{"rotate:-360", true},
+		{"rotate:nan", false},
+		{"rotate:infinity", false},
+		{"rotate:720", false},
+		{"rotate:", false},
+	}
+	for _, tt := range tests {
+		_, err := parseOps(tt.ops)
+		if tt.valid && err != nil {
+			t.Errorf("parseOps(%q) = %v, want no error", tt.ops, err)
+		}
+		if !tt.valid && !stderrors.Is(err, errors.ErrInvalidTransformation) {
+			t.Errorf("parseOps(%q) = %v, want ErrInvalidTransformation", tt.ops, err)
+		}
+	}
+}
+
+func TestParsePipelineFlatNumbers(t *testing.T) {
+	for _, query := range []string{
+		"blur=NaN",
+		"blur=1e6",
+		"brightness=Inf",
+		"contrast=NaN",
+		"rotate=-Inf",
+		"rotate=1e9",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parsePipeline(values); !stderrors.Is(err, errors.ErrInvalidTransformation) {
+			t.Errorf("parsePipeline(%q) = %v, want ErrInvalidTransformation", query, err)
+		}
+	}
+}
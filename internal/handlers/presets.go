@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zafchiel/image-service/internal/config"
+)
+
+// Preset is a named, server defined variant, e.g.
+//
+//	{"thumb": {"ops": ["resize:150x150,fit=cover"], "format": "webp", "quality": 70}}
+type Preset struct {
+	// Pipeline steps in the ops syntax, applied in order
+	Ops         []string `json:"ops"`
+	Format      string   `json:"format"`
+	Quality     int      `json:"quality"`
+	Compression string   `json:"compression"`
+	// Frame of animations to render, a number or "poster"
+	Frame string `json:"frame"`
+}
+
+// Query returns the preset as the equivalent query parameters, so presets
+// and ad hoc requests go through the same rendering and share cache entries
+func (p *Preset) Query() url.Values {
+	query := url.Values{}
+	if len(p.Ops) > 0 {
+		query.Set("ops", strings.Join(p.Ops, "|"))
+	}
+	if p.Format != "" {
+		query.Set("format", p.Format)
+	}
+	if p.Quality != 0 {
+		query.Set("q", strconv.Itoa(p.Quality))
+	}
+	if p.Compression != "" {
+		query.Set("compression", p.Compression)
+	}
+	if p.Frame != "" {
+		query.Set(frameParam, p.Frame)
+	}
+	return query
+}
+
+// Names of the paths under /image/{id}/ that other routes serve, a preset
+// with one of these names couldn't be requested
+var reservedPresetNames = []string{"meta", "tags"}
+
+// LoadPresets reads presets from a JSON file mapping names to presets.
+// An empty path means no presets are defined.
+func LoadPresets(path string, cfg *config.Config) (map[string]*Preset, error) {
+	presets := make(map[string]*Preset)
+	if path == "" {
+		return presets, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse presets: %w", err)
+	}
+
+	for name, preset := range presets {
+		if slices.Contains(reservedPresetNames, name) {
+			return nil, fmt.Errorf("preset %s: the name is reserved, don't use any of %v", name, reservedPresetNames)
+		}
+		query := preset.Query()
+		pipeline, err := parsePipeline(query)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		if err := checkOutputLimits(pipeline, cfg); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		if _, err := resolveOutputFormat(query.Get("format"), "", string(JPEG)); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		if _, err := resolveEncodeOptions(query, cfg); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		if _, err := parseFrame(query.Get(frameParam)); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+
+	return presets, nil
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+type FitMode string
+
+const (
+	// Stretch to exactly w x h, ignoring the aspect ratio
+	FitFill FitMode = "fill"
+	// Scale to fit inside w x h, preserving the aspect ratio
+	FitContain FitMode = "contain"
+	// Like contain, but never enlarge the image
+	FitInside FitMode = "inside"
+	// Scale to cover w x h and crop the overflow
+	FitCover FitMode = "cover"
+	// Scale to cover w x h without cropping
+	FitOutside FitMode = "outside"
+	// Like contain, then pad to exactly w x h with the bg color
+	FitPad FitMode = "pad"
+)
+
+var fitModes = []FitMode{FitFill, FitContain, FitInside, FitCover, FitOutside, FitPad}
+
+var resampleFilters = map[string]transform.ResampleFilter{
+	"nearest":    transform.NearestNeighbor,
+	"box":        transform.Box,
+	"linear":     transform.Linear,
+	"gaussian":   transform.Gaussian,
+	"mitchell":   transform.MitchellNetravali,
+	"catmullrom": transform.CatmullRom,
+	"lanczos":    transform.Lanczos,
+}
+
+var defaultBackground = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+// ResizeOp resizes to Width x Height. With a single dimension the other
+// one follows the aspect ratio.
+type ResizeOp struct {
+	Width, Height int
+	Fit           FitMode
+	// Name of the resampling filter, one of resampleFilters
+	Filter string
+	// Padding color for FitPad
+	Background color.NRGBA
+	// Which part of the image FitCover keeps
+	Gravity Gravity
+}
+
+func (op ResizeOp) Apply(img image.Image) (image.Image, error) {
+	return resize(img, op), nil
+}
+
+func (op ResizeOp) String() string {
+	var sb strings.Builder
+	sb.WriteString("resize:")
+	if op.Width > 0 {
+		sb.WriteString(strconv.Itoa(op.Width))
+	}
+	sb.WriteString("x")
+	if op.Height > 0 {
+		sb.WriteString(strconv.Itoa(op.Height))
+	}
+
+	// Options that don't change the output are left out
+	if op.Fit != FitFill {
+		sb.WriteString(",fit=" + string(op.Fit))
+	}
+	if op.Filter != "linear" {
+		sb.WriteString(",filter=" + op.Filter)
+	}
+	if op.Fit == FitPad && op.Background != defaultBackground {
+		c := op.Background
+		sb.WriteString(fmt.Sprintf(",bg=%02x%02x%02x%02x", c.R, c.G, c.B, c.A))
+	}
+	if op.Fit == FitCover && op.Gravity != GravityCenter {
+		sb.WriteString(",gravity=" + string(op.Gravity))
+	}
+	return sb.String()
+}
+
+// resizeOpFromQuery reads the flat w, h, fit, filter, bg and gravity query
+// parameters, returning nil when no dimension is set
+func resizeOpFromQuery(query url.Values) (Operation, error) {
+	width, err := parseDimension("w", query.Get("w"))
+	if err != nil {
+		return nil, err
+	}
+	height, err := parseDimension("h", query.Get("h"))
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 && height == 0 {
+		return nil, nil
+	}
+
+	return newResizeOp(width, height, query.Get)
+}
+
+// parseResizeOp parses the ops syntax "WxH[,option=value...]" where either
+// dimension may be left out, e.g. "resize:300x,filter=lanczos"
+func parseResizeOp(args string) (Operation, error) {
+	parts := strings.Split(args, ",")
+	widthValue, heightValue, _ := strings.Cut(parts[0], "x")
+
+	width, err := parseDimension("resize width", widthValue)
+	if err != nil {
+		return nil, err
+	}
+	height, err := parseDimension("resize height", heightValue)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 && height == 0 {
+		return nil, fmt.Errorf("%w: resize requires a width or a height", errors.ErrInvalidTransformation)
+	}
+
+	options := make(map[string]string)
+	for _, option := range parts[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "fit", "filter", "bg", "gravity":
+			options[name] = value
+		default:
+			return nil, fmt.Errorf("%w: unknown resize option %q", errors.ErrInvalidTransformation, name)
+		}
+	}
+
+	return newResizeOp(width, height, func(name string) string { return options[name] })
+}
+
+func newResizeOp(width, height int, option func(name string) string) (Operation, error) {
+	op := ResizeOp{
+		Width:      width,
+		Height:     height,
+		Fit:        FitFill,
+		Filter:     "linear",
+		Background: defaultBackground,
+		Gravity:    GravityCenter,
+	}
+
+	var err error
+	if value := option("fit"); value != "" {
+		op.Fit, err = parseFitMode(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := option("filter"); value != "" {
+		op.Filter = strings.ToLower(value)
+		if _, ok := resampleFilters[op.Filter]; !ok {
+			return nil, fmt.Errorf("%w: unknown filter %q", errors.ErrInvalidTransformation, value)
+		}
+	}
+
+	if value := option("bg"); value != "" {
+		op.Background, err = parseHexColor(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := option("gravity"); value != "" {
+		op.Gravity, err = parseGravity(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return op, nil
+}
+
+func resize(img image.Image, op ResizeOp) image.Image {
+	width, height, filter := op.Width, op.Height, resampleFilters[op.Filter]
+
+	scale := op.scale(img.Bounds().Dx(), img.Bounds().Dy())
+	if scale == 0 {
+		return transform.Resize(img, width, height, filter)
+	}
+
+	resized := scaleImage(img, scale, filter)
+	if width == 0 || height == 0 {
+		return resized
+	}
+	switch op.Fit {
+	case FitPad:
+		return padImage(resized, width, height, op.Background)
+	case FitCover:
+		return cropToGravity(resized, width, height, op.Gravity)
+	}
+	return resized
+}
+
+// scale returns the factor a srcWidth x srcHeight image is resampled by,
+// or 0 when it is stretched to exactly Width x Height
+func (op ResizeOp) scale(srcWidth, srcHeight int) float64 {
+	widthScale := float64(op.Width) / float64(srcWidth)
+	heightScale := float64(op.Height) / float64(srcHeight)
+
+	switch {
+	case op.Width == 0:
+		return heightScale
+	case op.Height == 0:
+		return widthScale
+	}
+
+	switch op.Fit {
+	case FitContain, FitInside, FitPad:
+		scale := math.Min(widthScale, heightScale)
+		if op.Fit == FitInside {
+			scale = math.Min(scale, 1)
+		}
+		return scale
+	case FitCover, FitOutside:
+		return math.Max(widthScale, heightScale)
+	}
+	return 0
+}
+
+// sizes returns the dimensions of the resampled image and of the final
+// output for a width x height source, without touching any pixels
+func (op ResizeOp) sizes(width, height int) (resampled, output image.Point) {
+	scale := op.scale(width, height)
+	if scale == 0 {
+		size := image.Pt(op.Width, op.Height)
+		return size, size
+	}
+
+	resampled = scaledSize(width, height, scale)
+	if op.Width == 0 || op.Height == 0 {
+		return resampled, resampled
+	}
+	switch op.Fit {
+	case FitPad:
+		return resampled, image.Pt(op.Width, op.Height)
+	case FitCover:
+		return resampled, image.Pt(min(op.Width, resampled.X), min(op.Height, resampled.Y))
+	}
+	return resampled, resampled
+}
+
+func scaleImage(img image.Image, scale float64, filter transform.ResampleFilter) image.Image {
+	if scale == 1 {
+		return img
+	}
+	size := scaledSize(img.Bounds().Dx(), img.Bounds().Dy(), scale)
+	return transform.Resize(img, size.X, size.Y, filter)
+}
+
+func scaledSize(width, height int, scale float64) image.Point {
+	return image.Pt(
+		max(1, int(math.Round(float64(width)*scale))),
+		max(1, int(math.Round(float64(height)*scale))),
+	)
+}
+
+// padImage centers img on a width x height canvas filled with background
+func padImage(img image.Image, width, height int, background color.NRGBA) image.Image {
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	bounds := img.Bounds()
+	offset := image.Pt((width-bounds.Dx())/2, (height-bounds.Dy())/2)
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+	return canvas
+}
+
+func parseDimension(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension < 0 {
+		return 0, fmt.Errorf("%w: %s must be a positive integer", errors.ErrInvalidTransformation, name)
+	}
+	return dimension, nil
+}
+
+func parseFitMode(value string) (FitMode, error) {
+	for _, mode := range fitModes {
+		if string(mode) == strings.ToLower(value) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("%w: fit must be one of %v", errors.ErrInvalidTransformation, fitModes)
+}
+
+// parseHexColor accepts RGB, RGBA, RRGGBB and RRGGBBAA hex colors with an
+// optional leading # as well as the "transparent" keyword.
+func parseHexColor(value string) (color.NRGBA, error) {
+	value = strings.TrimPrefix(strings.ToLower(value), "#")
+	if value == "transparent" {
+		return color.NRGBA{}, nil
+	}
+
+	if len(value) == 3 || len(value) == 4 {
+		expanded := make([]byte, 0, len(value)*2)
+		for i := 0; i < len(value); i++ {
+			expanded = append(expanded, value[i], value[i])
+		}
+		value = string(expanded)
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+
+	parsed, err := strconv.ParseUint(value, 16, 32)
+	if err != nil || len(value) != 8 {
+		return color.NRGBA{}, fmt.Errorf("%w: bg must be a hex color", errors.ErrInvalidTransformation)
+	}
+
+	return color.NRGBA{
+		R: uint8(parsed >> 24),
+		G: uint8(parsed >> 16),
+		B: uint8(parsed >> 8),
+		A: uint8(parsed),
+	}, nil
+}
@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"encoding/base64"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"github.com/zafchiel/image-service/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Resumable uploads implement the tus 1.0 core protocol with the creation,
+// termination and expiration extensions, see https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+var errUploadConflict = stderrors.New("upload was modified concurrently")
+
+type ResumableUploadHandler struct {
+	app *App
+}
+
+func NewResumableUploadHandler(app *App) *ResumableUploadHandler {
+	return &ResumableUploadHandler{app: app}
+}
+
+// tusResumable rejects requests for other protocol versions, every request
+// but OPTIONS has to state the version
+func tusResumable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, errors.ErrUnsupportedTusVersion.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleOptions describes what the server supports
+func (h *ResumableUploadHandler) HandleOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.app.Config.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCreate starts an upload. The filename, filetype, visibility and
+// strip_metadata metadata keys are used, others are ignored.
+func (h *ResumableUploadHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > h.app.Config.MaxUploadSize {
+		http.Error(w, errors.ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := newUploadOptions(r, h.app)
+	for _, name := range []string{"visibility", "strip_metadata"} {
+		if value, ok := metadata[name]; ok {
+			if err := opts.set(name, value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload := models.Upload{
+		ID:            id,
+		ExpiresAt:     time.Now().Add(h.app.Config.UploadExpiry),
+		Length:        length,
+		Filename:      metadata["filename"],
+		ContentType:   metadata["filetype"],
+		UserID:        opts.UserID,
+		Visibility:    opts.Visibility,
+		StripMetadata: opts.StripMetadata,
+	}
+	if err := h.app.DB.Create(&upload).Error; err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/uploads/%s", h.app.Config.PublicURL, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleHead reports how much of the upload was received, and the image
+// once it's complete
+func (h *ResumableUploadHandler) HandleHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.ImageID != nil {
+		h.setImageHeaders(w, *upload.ImageID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePatch appends the request body at Upload-Offset. The upload is
+// turned into an image by the request that completes it.
+func (h *ResumableUploadHandler) HandlePatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if upload.ImageID != nil || offset != upload.Offset {
+		http.Error(w, errors.ErrUploadOffsetMismatch.Error(), http.StatusConflict)
+		return
+	}
+
+	// Each request is stored as its own chunk. A request that is cut off
+	// keeps what was received, so the client resumes from there.
+	name, err := tempFilename()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := &partialBody{r: http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)}
+	if err := h.app.Storage.Save(name, body); err != nil {
+		h.app.Storage.Delete(name)
+		var maxBytesErr *http.MaxBytesError
+		if stderrors.As(err, &maxBytesErr) {
+			http.Error(w, "request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	info, err := h.app.Storage.Stat(name)
+	if err == nil {
+		if info.Size == 0 && body.err != nil {
+			h.app.Storage.Delete(name)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		err = h.appendChunk(upload, name, info.Size)
+	}
+	if err != nil {
+		h.app.Storage.Delete(name)
+		if stderrors.Is(err, errUploadConflict) {
+			http.Error(w, errors.ErrUploadOffsetMismatch.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Offset == upload.Length && !h.finalize(w, upload) {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if body.err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDelete cancels an upload. Completed uploads keep their image.
+func (h *ResumableUploadHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := h.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := deleteUpload(h.app, upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadUpload finds the upload in the path, uploads started by a logged in
+// user are only visible to them
+func (h *ResumableUploadHandler) loadUpload(w http.ResponseWriter, r *http.Request) (*models.Upload, bool) {
+	var upload models.Upload
+	if err := h.app.DB.First(&upload, "id = ?", r.PathValue("id")).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, errors.ErrUploadNotFound.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	userID, _ := session.UserID(r)
+	if upload.UserID != 0 && upload.UserID != userID {
+		http.Error(w, errors.ErrUploadNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		http.Error(w, errors.ErrUploadExpired.Error(), http.StatusGone)
+		return nil, false
+	}
+
+	return &upload, true
+}
+
+// appendChunk records a stored chunk, unless another request already
+// moved the upload past its offset
+func (h *ResumableUploadHandler) appendChunk(upload *models.Upload, filename string, size int64) error {
+	expiresAt := time.Now().Add(h.app.Config.UploadExpiry)
+	err := h.app.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Upload{}).
+			Where(map[string]any{"id": upload.ID, "offset": upload.Offset}).
+			Updates(map[string]any{"offset": upload.Offset + size, "expires_at": expiresAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUploadConflict
+		}
+
+		chunk := models.UploadChunk{UploadID: upload.ID, Offset: upload.Offset, Size: size, Filename: filename}
+		return tx.Create(&chunk).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	upload.Offset += size
+	upload.ExpiresAt = expiresAt
+	return nil
+}
+
+// finalize runs the complete upload through the same validation and
+// deduplication as multipart uploads. Uploads that aren't valid images are
+// deleted, since resuming them can't fix that.
+func (h *ResumableUploadHandler) finalize(w http.ResponseWriter, upload *models.Upload) bool {
+	var chunks []models.UploadChunk
+	// Chunks can only be added in order, so ids follow offsets
+	if err := h.app.DB.Where("upload_id = ?", upload.ID).Order("id").Find(&chunks).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	content := &chunkReader{storage: h.app.Storage, chunks: chunks}
+	defer content.Close()
+
+	opts := &uploadOptions{UserID: upload.UserID, Visibility: upload.Visibility, StripMetadata: upload.StripMetadata}
+	response, err := processUploadedFile(content, upload.Filename, upload.ContentType, h.app, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !response.Success {
+		if err := deleteUpload(h.app, upload); err != nil {
+			log.Println("failed to delete upload:", err)
+		}
+		statusCode := response.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusBadRequest
+		}
+		http.Error(w, response.Error, statusCode)
+		return false
+	}
+
+	if err := deleteChunks(h.app, upload.ID); err != nil {
+		log.Println("failed to delete upload chunks:", err)
+	}
+	if err := h.app.DB.Model(upload).Update("image_id", response.ID).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	h.setImageHeaders(w, response.ID)
+	return true
+}
+
+func (h *ResumableUploadHandler) setImageHeaders(w http.ResponseWriter, imageID uint) {
+	w.Header().Set("Image-ID", strconv.FormatUint(uint64(imageID), 10))
+	w.Header().Set("Image-URL", fmt.Sprintf("%s/image/%d", h.app.Config.PublicURL, imageID))
+}
+
+// ExpireUploads deletes uploads past their expiry along with their chunks
+func ExpireUploads(app *App) error {
+	var uploads []models.Upload
+	if err := app.DB.Where("expires_at < ?", time.Now()).Find(&uploads).Error; err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := deleteUpload(app, &upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteUpload(app *App, upload *models.Upload) error {
+	if err := deleteChunks(app, upload.ID); err != nil {
+		return err
+	}
+	return app.DB.Delete(upload).Error
+}
+
+func deleteChunks(app *App, uploadID string) error {
+	var chunks []models.UploadChunk
+	if err := app.DB.Where("upload_id = ?", uploadID).Find(&chunks).Error; err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := app.Storage.Delete(chunk.Filename); err != nil && !stderrors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return app.DB.Where("upload_id = ?", uploadID).Delete(&models.UploadChunk{}).Error
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, a comma
+// separated list of keys and base64 encoded values
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// partialBody ends a request body at the first read error instead of
+// failing, so the bytes received before a connection dropped can be
+// stored. Bodies exceeding the upload length still fail.
+type partialBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && err != io.EOF && !stderrors.As(err, &maxBytesErr) {
+		b.err, err = err, io.EOF
+	}
+	return n, err
+}
+
+// chunkReader reads the chunks of an upload one after another
+type chunkReader struct {
+	storage storage.Storage
+	chunks  []models.UploadChunk
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			file, err := cr.storage.Open(cr.chunks[0].Filename)
+			if err != nil {
+				return 0, err
+			}
+			cr.current, cr.chunks = file, cr.chunks[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current == nil {
+		return nil
+	}
+	return cr.current.Close()
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"github.com/zafchiel/image-service/internal/signing"
+)
+
+type SignURLHandler struct {
+	app *App
+}
+
+func NewSignURLHandler(app *App) *SignURLHandler {
+	return &SignURLHandler{app: app}
+}
+
+type signURLRequestBody struct {
+	ImageID uint `json:"image_id"`
+	// Transformation query string, e.g. "w=300&h=200&format=webp"
+	Query string `json:"query"`
+	// Lifetime of the URL in seconds, 0 means it never expires
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func (h *SignURLHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	if h.app.Config.URLSigningKey == "" {
+		http.Error(w, "URL signing is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != "" {
+		mimeType := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+		if mimeType != "application/json" {
+			http.Error(w, "Content-Type header must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+
+	var body signURLRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.ImageID == 0 {
+		http.Error(w, errors.ErrInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.ExpiresIn < 0 {
+		http.Error(w, "expires_in must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	query, err := url.ParseQuery(body.Query)
+	if err != nil {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	pipeline, err := parsePipeline(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkOutputLimits(pipeline, h.app.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := resolveEncodeOptions(query, h.app.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseFrame(query.Get(frameParam)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var imageMetadata models.ImageMetadata
+	userID, _ := session.UserID(r)
+	if err := h.app.DB.First(&imageMetadata, body.ImageID).Error; err != nil || !imageMetadata.CanView(userID) {
+		http.Error(w, errors.ErrImageNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var expires time.Time
+	if body.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+
+	path := fmt.Sprintf("/image/%d", imageMetadata.ID)
+	signed := signing.Sign([]byte(h.app.Config.URLSigningKey), path, query, expires)
+
+	response := map[string]string{"url": h.app.Config.PublicURL + path + "?" + signed.Encode()}
+	if !expires.IsZero() {
+		response["expires"] = strconv.FormatInt(expires.Unix(), 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	// Keep the & separators in the URL readable
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(response)
+}
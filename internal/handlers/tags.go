@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
+)
+
+type TagResponse struct {
+	Name       string `json:"name"`
+	ImageCount int64  `json:"image_count"`
+}
+
+type TagsHandler struct {
+	app *App
+}
+
+func NewTagsHandler(app *App) *TagsHandler {
+	return &TagsHandler{app: app}
+}
+
+type tagRequestBody struct {
+	Name string `json:"name"`
+}
+
+type imageTagsRequestBody struct {
+	Tags []string `json:"tags"`
+}
+
+// HandleList returns the caller's tags sorted by name, with the number of
+// images using each one
+func (h *TagsHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+
+	tags := make([]TagResponse, 0)
+	err := h.app.DB.Model(&models.Tag{}).
+		Select("tags.name, COUNT(image_metadata.id) AS image_count").
+		Joins("LEFT JOIN image_tags ON image_tags.tag_id = tags.id").
+		Joins("LEFT JOIN image_metadata ON image_metadata.id = image_tags.image_metadata_id AND image_metadata.deleted_at IS NULL").
+		Where("tags.user_id = ?", userID).
+		Group("tags.id").
+		Order("tags.name").
+		Scan(&tags).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]TagResponse{"tags": tags})
+}
+
+// HandleRename renames a tag on all of the caller's images
+func (h *TagsHandler) HandleRename(w http.ResponseWriter, r *http.Request) {
+	var body tagRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	names, err := normalizeTags([]string{body.Name})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(names) == 0 {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	tag, err := findTag(h.app.DB, r.PathValue("name"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), tagStatus(err))
+		return
+	}
+
+	if names[0] != tag.Name {
+		var count int64
+		if err := h.app.DB.Model(&models.Tag{}).Where("user_id = ? AND name = ?", userID, names[0]).Count(&count).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count > 0 {
+			http.Error(w, errors.ErrTagExists.Error(), http.StatusConflict)
+			return
+		}
+		if err := h.app.DB.Model(tag).Update("name", names[0]).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": tag.Name})
+}
+
+// HandleDelete removes a tag from all of the caller's images
+func (h *TagsHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	tag, err := findTag(h.app.DB, r.PathValue("name"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), tagStatus(err))
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM image_tags WHERE tag_id = ?", tag.ID).Error; err != nil {
+			return err
+		}
+		// Deleted for good, so the name can be used again
+		return tx.Unscoped().Delete(tag).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"success": "true", "message": "Tag deleted", "name": tag.Name})
+}
+
+// HandleAddToImage adds tags to an image, keeping the ones it already has
+func (h *TagsHandler) HandleAddToImage(w http.ResponseWriter, r *http.Request) {
+	var body imageTagsRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	names, err := normalizeTags(body.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := session.UserID(r)
+	imageMetadata, err := findOwnImage(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		var current []models.Tag
+		if err := tx.Model(imageMetadata).Association("Tags").Find(&current); err != nil {
+			return err
+		}
+		existing := make(map[string]bool, len(current))
+		for _, tag := range current {
+			existing[tag.Name] = true
+		}
+		added := 0
+		for _, name := range names {
+			if !existing[name] {
+				added++
+			}
+		}
+		if len(current)+added > maxTags {
+			return fmt.Errorf("%w: an image can have at most %d tags", errInvalidTags, maxTags)
+		}
+
+		tags, err := findOrCreateTags(tx, userID, names)
+		if err != nil {
+			return err
+		}
+		return tx.Model(imageMetadata).Association("Tags").Append(tags)
+	})
+	if err != nil {
+		if stderrors.Is(err, errInvalidTags) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeImage(w, imageMetadata)
+}
+
+// HandleRemoveFromImage removes a tag from an image, the tag itself is
+// kept even when no image uses it anymore
+func (h *TagsHandler) HandleRemoveFromImage(w http.ResponseWriter, r *http.Request) {
+	userID, _ := session.UserID(r)
+	imageMetadata, err := findOwnImage(h.app.DB, r.PathValue("id"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+	tag, err := findTag(h.app.DB, r.PathValue("tag"), userID)
+	if err != nil {
+		http.Error(w, err.Error(), tagStatus(err))
+		return
+	}
+
+	if err := h.app.DB.Model(imageMetadata).Association("Tags").Delete(tag); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeImage(w, imageMetadata)
+}
+
+// Wraps the errors of tag changes caused by the request
+var errInvalidTags = stderrors.New("invalid tags")
+
+func (h *TagsHandler) writeImage(w http.ResponseWriter, imageMetadata *models.ImageMetadata) {
+	if err := preloadImageFields(h.app.DB).First(imageMetadata, imageMetadata.ID).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newImageResponse(imageMetadata, h.app))
+}
+
+func findTag(db *gorm.DB, name string, userID uint) (*models.Tag, error) {
+	var tag models.Tag
+	if err := db.Where("user_id = ? AND name = ?", userID, name).First(&tag).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.ErrTagNotFound
+		}
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func tagStatus(err error) int {
+	if stderrors.Is(err, errors.ErrTagNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
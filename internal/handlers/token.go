@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/jwt"
+	"github.com/zafchiel/image-service/internal/models"
+	"gorm.io/gorm"
+)
+
+// Marks refresh tokens, they are opaque and only stored hashed
+const refreshTokenPrefix = "irt_"
+
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+type TokenHandler struct {
+	app *App
+}
+
+func NewTokenHandler(app *App) *TokenHandler {
+	return &TokenHandler{app: app}
+}
+
+// tokenRequestBody follows the OAuth 2 password and refresh_token grants
+type tokenRequestBody struct {
+	GrantType    string `json:"grant_type"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Handle issues an access token and a refresh token, either for the
+// user's credentials or in exchange for a refresh token
+func (h *TokenHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	if h.app.Config.JWTSigningKey == "" {
+		http.Error(w, "token authentication is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var body tokenRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+
+	var userID uint
+	var familyID string
+	switch body.GrantType {
+	case "password":
+		if body.Email == "" || body.Password == "" {
+			http.Error(w, "Email and password are required", http.StatusBadRequest)
+			return
+		}
+		user, err := models.NewUserModel(h.app.DB).LoginUser(body.Email, body.Password)
+		if err != nil {
+			http.Error(w, "Invalid email or password", http.StatusBadRequest)
+			return
+		}
+		userID = user.ID
+		// Every login starts a new family of refresh tokens
+		if familyID, err = randomID(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	case "refresh_token":
+		token, err := h.useRefreshToken(body.RefreshToken)
+		if err != nil {
+			if stderrors.Is(err, errors.ErrInvalidRefreshToken) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userID, familyID = token.UserID, token.FamilyID
+
+	default:
+		http.Error(w, "grant_type must be password or refresh_token", http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.issueTokens(userID, familyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// Tokens must not be cached by intermediaries
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleRevoke ends the session of a refresh token, revoking every token
+// of its family. Access tokens of the session stop working as well.
+func (h *TokenHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	var body tokenRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+
+	var token models.RefreshToken
+	err := h.app.DB.Where("hash = ?", hashToken(body.RefreshToken)).First(&token).Error
+	if err != nil && !stderrors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Unknown tokens are ignored, as in RFC 7009
+	if err == nil {
+		if err := revokeTokenFamily(h.app.DB, token.FamilyID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"success": "true", "message": "Token revoked"})
+}
+
+// useRefreshToken marks a refresh token as used. A token that was already
+// used was stolen or replayed, its family is revoked so neither the thief
+// nor the user can keep using it.
+func (h *TokenHandler) useRefreshToken(value string) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	if err := h.app.DB.Where("hash = ?", hashToken(value)).First(&token).Error; err != nil {
+		if stderrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.RevokedAt != nil || !now.Before(token.ExpiresAt) {
+		return nil, errors.ErrInvalidRefreshToken
+	}
+
+	// Only one of concurrent requests with the same token can mark it
+	result := h.app.DB.Model(&models.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := revokeTokenFamily(h.app.DB, token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errors.ErrInvalidRefreshToken
+	}
+	return &token, nil
+}
+
+func (h *TokenHandler) issueTokens(userID uint, familyID string) (*TokenResponse, error) {
+	cfg := h.app.Config
+	now := time.Now()
+
+	jti, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := jwt.Sign([]byte(cfg.JWTSigningKey), &jwt.Claims{
+		Subject:   strconv.FormatUint(uint64(userID), 10),
+		ID:        jti,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(cfg.AccessTokenTTL).Unix(),
+		SessionID: familyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := refreshTokenPrefix + id
+	err = h.app.DB.Create(&models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		Hash:      hashToken(refreshToken),
+		ExpiresAt: now.Add(cfg.RefreshTokenTTL),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(cfg.AccessTokenTTL.Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresIn: int64(cfg.RefreshTokenTTL.Seconds()),
+	}, nil
+}
+
+func revokeTokenFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// authenticateAccessToken verifies a JWT access token and checks that its
+// session wasn't revoked since it was issued
+func authenticateAccessToken(app *App, token string) (uint, error) {
+	if app.Config.JWTSigningKey == "" {
+		return 0, errors.ErrInvalidAccessToken
+	}
+	claims, err := jwt.Verify([]byte(app.Config.JWTSigningKey), token, time.Now())
+	if err != nil {
+		return 0, errors.ErrInvalidAccessToken
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil || userID == 0 {
+		return 0, errors.ErrInvalidAccessToken
+	}
+
+	var revoked int64
+	err = app.DB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NOT NULL", claims.SessionID).
+		Limit(1).Count(&revoked).Error
+	if err != nil {
+		return 0, err
+	}
+	if revoked > 0 {
+		return 0, errors.ErrInvalidAccessToken
+	}
+	return uint(userID), nil
+}
+
+// ExpireRefreshTokens deletes refresh tokens that can't be used anymore
+func ExpireRefreshTokens(app *App) error {
+	return app.DB.Where("expires_at < ?", time.Now()).Delete(&models.RefreshToken{}).Error
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+	"gorm.io/gorm"
+)
+
+type UpdateImageHandler struct {
+	app *App
+}
+
+func NewUpdateImageHandler(app *App) *UpdateImageHandler {
+	return &UpdateImageHandler{app: app}
+}
+
+// updateImageRequestBody lists the fields to change, omitted fields are
+// kept. Metadata keys are merged into the existing ones, null removes a key.
+type updateImageRequestBody struct {
+	imageFields
+	Visibility *models.Visibility `json:"visibility"`
+}
+
+func (h *UpdateImageHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, errors.ErrInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body updateImageRequestBody
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Visibility != nil {
+		if _, ok := models.ParseVisibility(string(*body.Visibility)); !ok {
+			http.Error(w, fmt.Sprintf("invalid visibility: %s, use one of the following: %v", *body.Visibility, models.Visibilities), http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID, _ := session.UserID(r)
+
+	imageMetadata, err := findOwnImage(h.app.DB, id, userID)
+	if err != nil {
+		http.Error(w, err.Error(), ownershipStatus(err))
+		return
+	}
+
+	err = h.app.DB.Transaction(func(tx *gorm.DB) error {
+		if body.Visibility != nil {
+			if err := tx.Model(imageMetadata).Update("visibility", *body.Visibility).Error; err != nil {
+				return err
+			}
+		}
+		return applyImageFields(tx, imageMetadata, &body.imageFields)
+	})
+	if err != nil {
+		if stderrors.Is(err, errors.ErrTooManyProperties) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := preloadImageFields(h.app.DB).First(imageMetadata, imageMetadata.ID).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newImageResponse(imageMetadata, h.app))
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zafchiel/image-service/internal/errors"
+)
+
+// Upper bound for the URLs fetched by one request
+const maxUploadURLs = 20
+
+// Extensions checked against the content of fetched images
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".tif", ".tiff"}
+
+type UploadURLHandler struct {
+	app *App
+}
+
+func NewUploadURLHandler(app *App) *UploadURLHandler {
+	return &UploadURLHandler{app: app}
+}
+
+type uploadURLRequestBody struct {
+	URLs          []string `json:"urls"`
+	Visibility    string   `json:"visibility"`
+	StripMetadata *bool    `json:"strip_metadata"`
+}
+
+func (h *UploadURLHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	ct := r.Header.Get("Content-Type")
+	if ct != "" {
+		mimeType := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+		if mimeType != "application/json" {
+			http.Error(w, "Content-Type header must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+
+	var body uploadURLRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.URLs) == 0 {
+		http.Error(w, errors.ErrNoImageUploaded.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.URLs) > maxUploadURLs {
+		http.Error(w, fmt.Sprintf("too many URLs, upload up to %d at once", maxUploadURLs), http.StatusBadRequest)
+		return
+	}
+
+	opts := newUploadOptions(r, h.app)
+	if body.Visibility != "" {
+		if err := opts.set("visibility", body.Visibility); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.StripMetadata != nil {
+		opts.set("strip_metadata", strconv.FormatBool(*body.StripMetadata))
+	}
+
+	responses := make([]UploadResponse, 0, len(body.URLs))
+	for _, rawURL := range body.URLs {
+		responses = append(responses, h.processURL(r, rawURL, opts))
+	}
+
+	sendUploadResponses(w, responses)
+}
+
+func (h *UploadURLHandler) processURL(r *http.Request, rawURL string, opts *uploadOptions) UploadResponse {
+	resp, err := h.app.Fetcher.Get(r.Context(), rawURL)
+	if err != nil {
+		return UploadResponse{Success: false, Error: fmt.Sprintf("Failed to fetch %s: %v", rawURL, err)}
+	}
+	defer resp.Body.Close()
+
+	// Servers label images with generic types like binary/octet-stream,
+	// only image types are checked against the content
+	contentType := resp.ContentType
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !strings.HasPrefix(mediaType, "image/") {
+		contentType = ""
+	}
+
+	response, err := processUploadedFile(resp.Body, remoteFilename(resp.URL), contentType, h.app, opts)
+	if err != nil {
+		return UploadResponse{Success: false, Error: err.Error()}
+	}
+	return *response
+}
+
+// remoteFilename names a fetched image after the last path segment. URLs
+// often end in script names like .php, so other extensions are dropped
+// instead of being reported as a mismatch.
+func remoteFilename(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	if ext := path.Ext(name); !slices.Contains(imageExtensions, strings.ToLower(ext)) {
+		return strings.TrimSuffix(name, ext)
+	}
+	return name
+}
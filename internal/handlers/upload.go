@@ -2,18 +2,27 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
+	stderrors "errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/zafchiel/image-service/internal/config"
+	"github.com/zafchiel/image-service/internal/errors"
+	"github.com/zafchiel/image-service/internal/fetch"
+	"github.com/zafchiel/image-service/internal/imageinfo"
+	"github.com/zafchiel/image-service/internal/imaging"
 	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
 	"gorm.io/gorm"
 )
 
@@ -23,6 +32,11 @@ type UploadResponse struct {
 	ID      uint   `json:"id,omitempty"`
 	Message string `json:"message,omitempty"`
 	URL     string `json:"url,omitempty"`
+	// The stored image, including the fields supplied with it
+	Image *ImageResponse `json:"image,omitempty"`
+
+	// Status for failed uploads, 400 when unset
+	statusCode int
 }
 
 type UploadHandler struct {
@@ -34,48 +48,147 @@ func NewUploadHandler(app *App) *UploadHandler {
 }
 
 func (h *UploadHandler) Handle(w http.ResponseWriter, r *http.Request) {
-	if err := h.validateRequest(r); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequestSize(h.app.Config))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse multipart form: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	files := r.MultipartForm.File["image"]
-	responses := h.processFiles(files)
+	opts := newUploadOptions(r, h.app)
+	responses, err := h.processParts(reader, opts)
+	if err != nil {
+		failed := UploadResponse{Success: false, Error: err.Error(), statusCode: http.StatusBadRequest}
+		var maxBytesErr *http.MaxBytesError
+		if stderrors.As(err, &maxBytesErr) {
+			failed.Error, failed.statusCode = errors.ErrRequestTooLarge.Error(), http.StatusRequestEntityTooLarge
+		}
+		// The images before the error are stored, so their responses are
+		// sent along with it
+		if len(responses) > 0 {
+			sendUploadResponses(w, append(responses, failed))
+			return
+		}
+		http.Error(w, failed.Error, failed.statusCode)
+		return
+	}
+	if len(responses) == 0 {
+		http.Error(w, errors.ErrNoImageUploaded.Error(), http.StatusBadRequest)
+		return
+	}
 
-	h.sendResponse(w, responses)
+	sendUploadResponses(w, responses)
 }
 
-func (h *UploadHandler) validateRequest(r *http.Request) error {
-	r.Body = http.MaxBytesReader(nil, r.Body, h.app.Config.MaxUploadSize)
+// uploadOptions describes who owns the uploaded images and who can see them
+type uploadOptions struct {
+	// 0 for anonymous uploads
+	UserID     uint
+	Visibility models.Visibility
+	// Remove EXIF, GPS and other metadata before storing the original
+	StripMetadata bool
+	// Descriptive fields, only applied to the next image
+	Fields imageFields
+}
 
-	if err := r.ParseMultipartForm(h.app.Config.MaxUploadSize); err != nil {
-		return fmt.Errorf("failed to parse multipart form: %w", err)
+func newUploadOptions(r *http.Request, app *App) *uploadOptions {
+	opts := &uploadOptions{
+		Visibility:    models.VisibilityPublic,
+		StripMetadata: app.Config.StripMetadata,
 	}
+	opts.UserID, _ = session.UserID(r)
+	return opts
+}
 
-	if len(r.MultipartForm.File["image"]) == 0 {
-		return errors.New("no image uploaded")
+// set applies a form field. Visibility and stripping affect all the
+// images that follow, the image fields only the next one.
+func (opts *uploadOptions) set(name, value string) error {
+	if ok, err := opts.Fields.set(name, value); ok {
+		return err
 	}
 
+	switch name {
+	case "strip_metadata":
+		strip, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid strip_metadata: %s", value)
+		}
+		opts.StripMetadata = strip
+
+	case "visibility":
+		visibility, ok := models.ParseVisibility(value)
+		if !ok {
+			return fmt.Errorf("invalid visibility: %s, use one of the following: %v", value, models.Visibilities)
+		}
+		if visibility == models.VisibilityPrivate && opts.UserID == 0 {
+			return stderrors.New("log in to upload private images")
+		}
+		opts.Visibility = visibility
+	}
 	return nil
 }
 
-func (h *UploadHandler) processFiles(files []*multipart.FileHeader) []UploadResponse {
-	responses := make([]UploadResponse, 0, len(files))
-	for _, fileHeader := range files {
-		response := h.processFile(fileHeader)
-		responses = append(responses, response)
+// processParts streams the form one part at a time, so images are never
+// held in memory. Fields have to come before the images they apply to.
+// Each image is stored as soon as it's read, so on an error the responses
+// of the images before it are returned too.
+func (h *UploadHandler) processParts(reader *multipart.Reader, opts *uploadOptions) ([]UploadResponse, error) {
+	var responses []UploadResponse
+	var fields, files int
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return responses, fmt.Errorf("failed to parse multipart form: %w", err)
+		}
+
+		if part.FileName() == "" {
+			if fields++; fields > maxFormFields {
+				return responses, fmt.Errorf("too many form fields, the maximum is %d", maxFormFields)
+			}
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			part.Close()
+			if err != nil {
+				return responses, fmt.Errorf("failed to parse multipart form: %w", err)
+			}
+			if len(value) > maxFieldSize {
+				return responses, fmt.Errorf("form field %s is too long, the maximum is %d bytes", part.FormName(), maxFieldSize)
+			}
+			if err := opts.set(part.FormName(), string(value)); err != nil {
+				return responses, err
+			}
+			continue
+		}
+
+		if files++; files > maxUploadFiles {
+			return responses, fmt.Errorf("too many files, upload up to %d at once", maxUploadFiles)
+		}
+		if part.FormName() == "image" {
+			responses = append(responses, h.processFile(part, opts))
+			opts.Fields = imageFields{}
+		}
+		part.Close()
 	}
-	return responses
 }
 
-func (h *UploadHandler) processFile(fileHeader *multipart.FileHeader) UploadResponse {
-	file, err := fileHeader.Open()
-	if err != nil {
-		return UploadResponse{Success: false, Error: fmt.Sprintf("Failed to open file: %v", err)}
-	}
-	defer file.Close()
+const (
+	// Upper bound for the value of a non-file form field
+	maxFieldSize = 16 << 10
+	// Upper bounds for the parts of one request
+	maxFormFields  = 100
+	maxUploadFiles = 20
+)
+
+// maxUploadRequestSize bounds the whole request, every file and field at
+// their largest along with room for the part headers
+func maxUploadRequestSize(cfg *config.Config) int64 {
+	return maxUploadFiles*cfg.MaxUploadSize + maxFormFields*maxFieldSize + 1<<20
+}
 
-	response, err := processUploadedFile(file, fileHeader, h.app)
+func (h *UploadHandler) processFile(part *multipart.Part, opts *uploadOptions) UploadResponse {
+	response, err := processUploadedFile(part, part.FileName(), part.Header.Get("Content-Type"), h.app, opts)
 	if err != nil {
 		return UploadResponse{Success: false, Error: err.Error()}
 	}
@@ -83,81 +196,283 @@ func (h *UploadHandler) processFile(fileHeader *multipart.FileHeader) UploadResp
 	return *response
 }
 
-func (h *UploadHandler) sendResponse(w http.ResponseWriter, responses []UploadResponse) {
+func sendUploadResponses(w http.ResponseWriter, responses []UploadResponse) {
 	w.Header().Set("Content-Type", "application/json")
-	statusCode := h.determineStatusCode(responses)
+	statusCode := uploadStatusCode(responses)
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(responses)
 }
 
-func (h *UploadHandler) determineStatusCode(responses []UploadResponse) int {
+func uploadStatusCode(responses []UploadResponse) int {
 	for _, response := range responses {
 		if !response.Success {
+			if response.statusCode != 0 {
+				return response.statusCode
+			}
 			return http.StatusBadRequest
 		}
 	}
 	return http.StatusOK
 }
 
-func processUploadedFile(file multipart.File, header *multipart.FileHeader, app *App) (*UploadResponse, error) {
-	if err := validateImage(header, app.Config.MaxUploadSize); err != nil {
-		return &UploadResponse{Success: false, Error: err.Error()}, nil
+// processUploadedFile validates and stores an image, deduplicating it by
+// its content. The filename and the content type are the ones claimed by
+// the client.
+func processUploadedFile(content io.Reader, filename, contentType string, app *App, opts *uploadOptions) (*UploadResponse, error) {
+	// The image is written to a temporary file while it's being hashed and
+	// only moved to its content addressed name once it's validated
+	tempName, fileHash, err := saveTemp(app, http.MaxBytesReader(nil, io.NopCloser(content), app.Config.MaxUploadSize))
+	defer app.Storage.Delete(tempName)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if stderrors.As(err, &maxBytesErr) || stderrors.Is(err, fetch.ErrResponseTooLarge) {
+			return &UploadResponse{
+				Success:    false,
+				Error:      fmt.Sprintf("the uploaded image is too big. Please upload an image up to %v", app.Config.MaxUploadSize),
+				statusCode: http.StatusRequestEntityTooLarge,
+			}, nil
+		}
+		return &UploadResponse{Success: false, Error: "Failed to save file"}, nil
 	}
 
-	fileBytes, err := io.ReadAll(file)
+	file, err := app.Storage.Open(tempName)
 	if err != nil {
 		return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
 	}
+	defer file.Close()
+
+	format, err := validateImage(file, filename, contentType)
+	if err != nil {
+		return &UploadResponse{Success: false, Error: err.Error()}, nil
+	}
+
+	if err := rewind(file); err != nil {
+		return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
+	}
+	if err := checkImageLimits(file, app.Config); err != nil {
+		if stderrors.Is(err, errors.ErrImageTooLarge) {
+			return &UploadResponse{Success: false, Error: err.Error(), statusCode: http.StatusRequestEntityTooLarge}, nil
+		}
+		return &UploadResponse{Success: false, Error: errors.ErrCorruptImage.Error()}, nil
+	}
+	if format == "gif" {
+		if err := rewind(file); err != nil {
+			return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
+		}
+		// Animations are decoded with all of their frames at once
+		if err := checkGIFLimits(file, app.Config); err != nil {
+			if stderrors.Is(err, errors.ErrImageTooLarge) {
+				return &UploadResponse{Success: false, Error: err.Error(), statusCode: http.StatusRequestEntityTooLarge}, nil
+			}
+			return &UploadResponse{Success: false, Error: errors.ErrCorruptImage.Error()}, nil
+		}
+	}
+
+	if opts.StripMetadata {
+		if err := rewind(file); err != nil {
+			return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
+		}
+		strippedName, strippedHash, err := saveStripped(app, file)
+		defer app.Storage.Delete(strippedName)
+		if err != nil {
+			return &UploadResponse{Success: false, Error: fmt.Sprintf("Failed to strip metadata: %v", err)}, nil
+		}
+
+		file.Close()
+		if file, err = app.Storage.Open(strippedName); err != nil {
+			return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
+		}
+		defer file.Close()
+		tempName, fileHash = strippedName, strippedHash
+	}
 
-	fileHash := generateFileHash(fileBytes)
-	fileExt := filepath.Ext(header.Filename)
-	newFilename := fileHash + fileExt
+	// Decoding the whole image rejects corrupt and truncated files
+	if err := rewind(file); err != nil {
+		return &UploadResponse{Success: false, Error: "Failed to read file"}, nil
+	}
+	info, err := imageinfo.Extract(file)
+	if err != nil {
+		return &UploadResponse{Success: false, Error: errors.ErrCorruptImage.Error()}, nil
+	}
 
-	existingFile, err := checkExistingFile(app.DB, newFilename)
+	existingFile, err := findUserImage(app.DB, fileHash, opts.UserID)
 	if err != nil {
 		return &UploadResponse{Success: false, Error: "Database error"}, nil
 	}
 	if existingFile != nil {
+		// The fields sent with the upload are ignored, PATCH /image/{id}
+		// changes those of the existing image
+		if err := preloadImageFields(app.DB).First(existingFile, existingFile.ID).Error; err != nil {
+			return &UploadResponse{Success: false, Error: "Database error"}, nil
+		}
+		image := newImageResponse(existingFile, app)
 		return &UploadResponse{
 			Success: true,
 			ID:      existingFile.ID,
 			Message: "File already exists",
-			URL:     fmt.Sprintf("http://localhost:8080/image/%d", existingFile.ID),
+			URL:     image.URL,
+			Image:   &image,
 		}, nil
 	}
 
-	if err := app.Storage.Save(newFilename, bytes.NewReader(fileBytes)); err != nil {
-		return &UploadResponse{Success: false, Error: "Failed to save file"}, nil
-	}
-
 	newFile := models.ImageMetadata{
-		Filename: newFilename,
-		Format:   fileExt[1:], // Remove the leading dot
-		Size:     header.Size,
+		Format:     format,
+		UserID:     opts.UserID,
+		Visibility: opts.Visibility,
+
+		Width:         info.Width,
+		Height:        info.Height,
+		ColorModel:    info.ColorModel,
+		BitDepth:      info.BitDepth,
+		HasAlpha:      info.HasAlpha,
+		FrameCount:    info.FrameCount,
+		DominantColor: info.DominantColor,
+		CameraMake:    info.CameraMake,
+		CameraModel:   info.CameraModel,
+		TakenAt:       info.TakenAt,
+		Orientation:   info.Orientation,
+		GPSLatitude:   info.GPSLatitude,
+		GPSLongitude:  info.GPSLongitude,
+	}
+	// A blob released while this upload reused it is created again on
+	// retry, one created by another upload of the same content is reused
+	for attempt := 0; attempt < maxBlobAttempts; attempt++ {
+		var createdFile string
+		err = app.DB.Transaction(func(tx *gorm.DB) error {
+			blob, created, err := acquireBlob(tx, app.Storage, tempName, fileHash, format)
+			if err != nil {
+				return err
+			}
+			if created {
+				createdFile = blob.Filename
+			}
+			newFile.BlobID, newFile.Filename, newFile.Size = blob.ID, blob.Filename, blob.Size
+			if err := tx.Create(&newFile).Error; err != nil {
+				return err
+			}
+			return applyImageFields(tx, &newFile, &opts.Fields)
+		})
+		if err != nil && createdFile != "" {
+			restoreBlobFile(app.Storage, createdFile, tempName)
+		}
+		if !isBlobConflict(err) {
+			break
+		}
+		newFile.ID = 0
 	}
-	if err := app.DB.Create(&newFile).Error; err != nil {
-		return &UploadResponse{Success: false, Error: "Failed to save file metadata"}, nil
+	if err != nil {
+		return &UploadResponse{Success: false, Error: "Failed to save file"}, nil
+	}
+	if err := preloadImageFields(app.DB).First(&newFile, newFile.ID).Error; err != nil {
+		return &UploadResponse{Success: false, Error: "Database error"}, nil
 	}
 
+	image := newImageResponse(&newFile, app)
 	return &UploadResponse{
 		Success: true,
 		ID:      newFile.ID,
-		Message: fmt.Sprintf("File %s uploaded successfully", header.Filename),
-		URL:     fmt.Sprintf("http://localhost:8080/image/%d", newFile.ID),
+		Message: fmt.Sprintf("File %s uploaded successfully", filename),
+		URL:     image.URL,
+		Image:   &image,
 	}, nil
 }
 
-func validateImage(header *multipart.FileHeader, maxUploadSize int64) error {
-	if header.Size > maxUploadSize {
-		return fmt.Errorf("the uploaded image is too big: %v. Please upload an image up to %v", header.Size, maxUploadSize)
+// saveTemp writes content to a new temporary file and returns its name
+// and the hex encoded SHA-256 of the content
+func saveTemp(app *App, content io.Reader) (string, string, error) {
+	name, err := tempFilename()
+	if err != nil {
+		return "", "", err
 	}
 
-	contentType := strings.Split(header.Header.Get("Content-Type"), "/")[1]
-	if !isSupportedFormat(contentType) {
-		return fmt.Errorf("unsupported image format: %s, upload one of the following: %v", contentType, supportedFormats)
+	hash := sha256.New()
+	if err := app.Storage.Save(name, io.TeeReader(content, hash)); err != nil {
+		return name, "", err
 	}
+	return name, hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	return nil
+// saveStripped writes a copy of the image without metadata to a new
+// temporary file
+func saveStripped(app *App, file io.Reader) (string, string, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(imaging.StripMetadataTo(writer, file))
+	}()
+
+	name, hash, err := saveTemp(app, reader)
+	// Unblocks the goroutine when saving stopped early
+	reader.CloseWithError(err)
+	return name, hash, err
+}
+
+func tempFilename() (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return "tmp/upload-" + id, nil
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func rewind(file io.Seeker) error {
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// validateImage detects the real format from the file content and returns
+// it. The Content-Type and the filename extension sent by the client are
+// only checked against it, never trusted.
+func validateImage(file io.Reader, filename, contentType string) (string, error) {
+	signature := make([]byte, 16)
+	n, err := io.ReadFull(file, signature)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", errors.ErrInvalidFormat
+	}
+
+	format := imaging.DetectFormat(signature[:n])
+	if format == "" {
+		return "", errors.ErrInvalidFormat
+	}
+	if !isSupportedFormat(format) {
+		return "", fmt.Errorf("unsupported image format: %s, upload one of the following: %v", format, supportedFormats)
+	}
+
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", fmt.Errorf("invalid Content-Type: %s", contentType)
+		}
+		// Clients that don't know the type send a generic one
+		if mediaType != "application/octet-stream" && !sameFormat(strings.TrimPrefix(mediaType, "image/"), format) {
+			return "", fmt.Errorf("%w: %s is not %s", errors.ErrFormatMismatch, format, mediaType)
+		}
+	}
+
+	if ext := filepath.Ext(filename); ext != "" && !sameFormat(strings.ToLower(ext[1:]), format) {
+		return "", fmt.Errorf("%w: %s is not %s", errors.ErrFormatMismatch, format, ext)
+	}
+
+	polyglot, err := imaging.IsPolyglot(io.MultiReader(bytes.NewReader(signature[:n]), file), format)
+	if err != nil {
+		return "", err
+	}
+	if polyglot {
+		return "", errors.ErrPolyglotFile
+	}
+
+	return format, nil
+}
+
+func sameFormat(a, b string) bool {
+	return normalizeFormat(ImageFormat(a)) == normalizeFormat(ImageFormat(b))
 }
 
 func isSupportedFormat(format string) bool {
@@ -169,16 +484,16 @@ func isSupportedFormat(format string) bool {
 	return false
 }
 
-func generateFileHash(fileBytes []byte) string {
-	hash := sha256.Sum256(fileBytes)
-	return hex.EncodeToString(hash[:])
-}
-
-func checkExistingFile(db *gorm.DB, filename string) (*models.ImageMetadata, error) {
+// findUserImage returns the user's image with the given content, if they
+// uploaded it before. Other users' images are never returned, they get
+// their own image sharing the blob.
+func findUserImage(db *gorm.DB, hash string, userID uint) (*models.ImageMetadata, error) {
 	var existingFile models.ImageMetadata
-	result := db.Where("filename = ?", filename).First(&existingFile)
+	result := db.Joins("JOIN blobs ON blobs.id = image_metadata.blob_id").
+		Where("blobs.hash = ? AND image_metadata.user_id = ?", hash, userID).
+		First(&existingFile)
 	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		if stderrors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, nil
 		}
 		return nil, result.Error
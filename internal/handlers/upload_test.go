@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zafchiel/image-service/internal/models"
+	"github.com/zafchiel/image-service/internal/session"
+)
+
+// postUpload sends the form built by write to the upload handler
+func postUpload(t *testing.T, app *App, write func(form *multipart.Writer)) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	write(form)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = session.WithUserID(r, 1)
+	w := httptest.NewRecorder()
+	NewUploadHandler(app).Handle(w, r)
+	return w
+}
+
+func addImage(t *testing.T, form *multipart.Writer, content []byte) {
+	t.Helper()
+	part, err := form.CreateFormFile("image", "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+}
+
+// checkStoredReported checks that every stored image is in the responses,
+// which end with the error
+func checkStoredReported(t *testing.T, app *App, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+	}
+
+	var responses []UploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("body = %s, want upload responses: %v", w.Body, err)
+	}
+	var images []models.ImageMetadata
+	if err := app.DB.Find(&images).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(images) == 0 || len(responses) != len(images)+1 {
+		t.Fatalf("%d responses for %d stored images, want one more", len(responses), len(images))
+	}
+
+	for i, image := range images {
+		if !responses[i].Success || responses[i].ID != image.ID {
+			t.Errorf("response %d = %+v, want image %d", i, responses[i], image.ID)
+		}
+	}
+	if last := responses[len(responses)-1]; last.Success || last.Error == "" {
+		t.Errorf("last response = %+v, want the error", last)
+	}
+}
+
+func TestUploadReportsImagesBeforeTooManyFiles(t *testing.T) {
+	app := newTestApp(t)
+	w := postUpload(t, app, func(form *multipart.Writer) {
+		for i := 0; i <= maxUploadFiles; i++ {
+			addImage(t, form, encodePNG(t, i+1, 1))
+		}
+	})
+	checkStoredReported(t, app, w, http.StatusBadRequest)
+}
+
+func TestUploadReportsImagesBeforeLongField(t *testing.T) {
+	app := newTestApp(t)
+	w := postUpload(t, app, func(form *multipart.Writer) {
+		addImage(t, form, encodePNG(t, 2, 2))
+		form.WriteField("title", strings.Repeat("a", maxFieldSize+1))
+		addImage(t, form, encodePNG(t, 3, 3))
+	})
+	checkStoredReported(t, app, w, http.StatusBadRequest)
+}
+
+func TestUploadReportsImagesBeforeRequestTooLarge(t *testing.T) {
+	app := newTestApp(t)
+	app.Config.MaxUploadSize = 1 << 10
+	w := postUpload(t, app, func(form *multipart.Writer) {
+		addImage(t, form, encodePNG(t, 2, 2))
+		part, _ := form.CreateFormFile("other", "padding.bin")
+		part.Write(make([]byte, maxUploadRequestSize(app.Config)))
+	})
+	checkStoredReported(t, app, w, http.StatusRequestEntityTooLarge)
+}
+
+func TestUploadWithoutStoredImagesFailsPlainly(t *testing.T) {
+	app := newTestApp(t)
+	w := postUpload(t, app, func(form *multipart.Writer) {
+		form.WriteField("visibility", "hidden")
+		addImage(t, form, encodePNG(t, 2, 2))
+	})
+	if w.Code != http.StatusBadRequest || strings.HasPrefix(w.Body.String(), "[") {
+		t.Errorf("response = %d %s, want a plain 400", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,206 @@
+package imageinfo
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/zafchiel/image-service/internal/imaging"
+)
+
+// Info describes the pixel data and the camera metadata of an image
+type Info struct {
+	Width         int
+	Height        int
+	ColorModel    string
+	BitDepth      int
+	HasAlpha      bool
+	FrameCount    int
+	DominantColor string
+
+	// EXIF fields, zero when the image carries no EXIF data
+	CameraMake   string
+	CameraModel  string
+	TakenAt      *time.Time
+	Orientation  int
+	GPSLatitude  *float64
+	GPSLongitude *float64
+}
+
+// Extract decodes the image and gathers its properties. Images without
+// EXIF data are not an error. The image is read several times, rewinding
+// r in between.
+func Extract(r io.ReadSeeker) (*Info, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	info := &Info{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		ColorModel:    colorModelName(img.ColorModel()),
+		BitDepth:      bitDepth(img.ColorModel()),
+		HasAlpha:      hasAlpha(img),
+		FrameCount:    1,
+		DominantColor: DominantColor(img),
+	}
+
+	// Report the dimensions the image is displayed with
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if x, err := exif.Decode(r); err == nil {
+		readExif(x, info)
+		if imaging.SwapsDimensions(info.Orientation) {
+			info.Width, info.Height = info.Height, info.Width
+		}
+	}
+
+	if format == "gif" {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// Counting frames doesn't need their pixels
+		if gifInfo, err := imaging.ScanGIF(r); err == nil {
+			info.FrameCount = gifInfo.Frames
+		}
+	}
+
+	return info, nil
+}
+
+func readExif(x *exif.Exif, info *Info) {
+	info.CameraMake = exifString(x, exif.Make)
+	info.CameraModel = exifString(x, exif.Model)
+
+	if takenAt, err := x.DateTime(); err == nil {
+		info.TakenAt = &takenAt
+	}
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil {
+			info.Orientation = orientation
+		}
+	}
+
+	if lat, long, err := x.LatLong(); err == nil {
+		info.GPSLatitude = &lat
+		info.GPSLongitude = &long
+	}
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func colorModelName(model color.Model) string {
+	switch model {
+	case color.RGBAModel, color.NRGBAModel, color.RGBA64Model, color.NRGBA64Model:
+		return "rgb"
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.YCbCrModel, color.NYCbCrAModel:
+		return "ycbcr"
+	case color.CMYKModel:
+		return "cmyk"
+	case color.AlphaModel, color.Alpha16Model:
+		return "alpha"
+	}
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+	return "unknown"
+}
+
+// bitDepth is the number of bits per channel
+func bitDepth(model color.Model) int {
+	switch model {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model, color.Alpha16Model:
+		return 16
+	}
+	return 8
+}
+
+func hasAlpha(img image.Image) bool {
+	switch model := img.ColorModel().(type) {
+	case color.Palette:
+		for _, c := range model {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	default:
+		switch model {
+		case color.RGBAModel, color.NRGBAModel, color.RGBA64Model, color.NRGBA64Model,
+			color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+			return true
+		}
+		return false
+	}
+}
+
+// Size of the sampling grid used to find the dominant color
+const dominantColorSamples = 64
+
+// DominantColor returns the most common color of the image as a hex
+// string. Colors are bucketed to 4 bits per channel and the winning bucket
+// is averaged, so near identical shades count together.
+func DominantColor(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[uint16]*bucket)
+
+	bounds := img.Bounds()
+	stepX := max(1, bounds.Dx()/dominantColorSamples)
+	stepY := max(1, bounds.Dy()/dominantColorSamples)
+
+	var best *bucket
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			// Mostly transparent pixels don't contribute to what people see
+			if c.A < 128 {
+				continue
+			}
+
+			key := uint16(c.R>>4)<<8 | uint16(c.G>>4)<<4 | uint16(c.B>>4)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+			b.count++
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+
+			if best == nil || b.count > best.count {
+				best = b
+			}
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
@@ -0,0 +1,126 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+// Coalesce renders every frame of an animation onto the full canvas the
+// way viewers show it, applying the disposal method of each frame before
+// the next one is drawn
+func Coalesce(anim *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	for _, frame := range anim.Image {
+		bounds = bounds.Union(frame.Bounds())
+	}
+
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.RGBA, len(anim.Image))
+	for i, frame := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = cloneRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// Browsers clear to transparent rather than the background color
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// EncodeAnimation encodes frames covering the whole canvas as an animated
+// GIF. Each frame gets its own palette of its most common colors.
+func EncodeAnimation(w io.Writer, frames []image.Image, delays []int, loopCount int) error {
+	anim := &gif.GIF{LoopCount: loopCount}
+	for i, frame := range frames {
+		bounds := frame.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), paletteOf(frame))
+		// Nearest colors rather than dithering, dither patterns flicker
+		// when they change between frames
+		draw.Draw(paletted, paletted.Bounds(), frame, bounds.Min, draw.Src)
+
+		anim.Image = append(anim.Image, paletted)
+		if i < len(delays) {
+			anim.Delay = append(anim.Delay, delays[i])
+		} else {
+			anim.Delay = append(anim.Delay, 0)
+		}
+		// Frames replace the whole canvas, clearing it keeps the previous
+		// frame from showing through transparent pixels
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// paletteOf builds a palette of the most common colors, bucketed to 5 bits
+// per channel, with a transparent entry when the image has transparency
+func paletteOf(img image.Image) color.Palette {
+	type bucket struct {
+		r, g, b, count int
+	}
+	buckets := make(map[int]*bucket)
+	transparent := false
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				transparent = true
+				continue
+			}
+			key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+			b.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].count > sorted[j].count })
+
+	size := 256
+	if transparent {
+		size--
+	}
+	palette := make(color.Palette, 0, 256)
+	for _, b := range sorted[:min(size, len(sorted))] {
+		palette = append(palette, color.RGBA{R: uint8(b.r / b.count), G: uint8(b.g / b.count), B: uint8(b.b / b.count), A: 255})
+	}
+	if transparent || len(palette) == 0 {
+		palette = append(palette, color.Transparent)
+	}
+	return palette
+}
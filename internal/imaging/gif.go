@@ -0,0 +1,114 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// GIF block introducers
+const (
+	gifExtension  = 0x21
+	gifImage      = 0x2c
+	gifTrailer    = 0x3b
+	gifColorTable = 0x80
+)
+
+// GIFInfo describes a GIF without its pixel data
+type GIFInfo struct {
+	// Logical screen size, every frame lies within it
+	Width, Height int
+	Frames        int
+}
+
+// ScanGIF walks the blocks of a GIF up to its trailer without
+// decompressing any frame, so animations can be checked against limits
+// before they are decoded
+func ScanGIF(r io.Reader) (*GIFInfo, error) {
+	return scanGIF(bufio.NewReader(r), io.Discard)
+}
+
+// scanGIF reads up to and including the trailer, writing the data of
+// extension blocks, such as comments, to metadata
+func scanGIF(r *bufio.Reader, metadata io.Writer) (*GIFInfo, error) {
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte("GIF87a")) && !bytes.HasPrefix(header, []byte("GIF89a")) {
+		return nil, ErrMalformedImage
+	}
+	info := &GIFInfo{
+		Width:  int(binary.LittleEndian.Uint16(header[6:8])),
+		Height: int(binary.LittleEndian.Uint16(header[8:10])),
+	}
+	if err := skipGIFColorTable(r, header[10]); err != nil {
+		return nil, err
+	}
+
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		data := io.Discard
+		switch introducer {
+		case gifExtension:
+			// Label
+			if _, err := r.Discard(1); err != nil {
+				return nil, err
+			}
+			data = metadata
+		case gifImage:
+			// Position, size and flags, then the LZW minimum code size
+			// after the color table
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return nil, err
+			}
+			if err := skipGIFColorTable(r, descriptor[8]); err != nil {
+				return nil, err
+			}
+			if _, err := r.Discard(1); err != nil {
+				return nil, err
+			}
+			info.Frames++
+		case gifTrailer:
+			return info, nil
+		default:
+			return nil, ErrMalformedImage
+		}
+
+		if err := copyGIFSubBlocks(data, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func skipGIFColorTable(r *bufio.Reader, flags byte) error {
+	if flags&gifColorTable == 0 {
+		return nil
+	}
+	_, err := r.Discard(3 << (flags&0x07 + 1))
+	return err
+}
+
+// copyGIFSubBlocks copies length prefixed data up to the empty block
+// ending it, without the lengths
+func copyGIFSubBlocks(w io.Writer, r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var formatSignatures = []struct {
+	format string
+	match  func(data []byte) bool
+}{
+	{"jpeg", func(data []byte) bool { return bytes.HasPrefix(data, jpegSignature) }},
+	{"png", func(data []byte) bool { return bytes.HasPrefix(data, pngSignature) }},
+	{"gif", func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+	}},
+	{"webp", func(data []byte) bool {
+		return len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+	}},
+	{"bmp", func(data []byte) bool { return bytes.HasPrefix(data, []byte("BM")) }},
+	{"tiff", func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+	}},
+}
+
+// DetectFormat identifies the image format from its magic bytes, returning
+// an empty string when it isn't a known image format
+func DetectFormat(data []byte) string {
+	for _, signature := range formatSignatures {
+		if signature.match(data) {
+			return signature.format
+		}
+	}
+	return ""
+}
+
+// Markup that browsers or interpreters would act on if a file was served
+// with the wrong content type
+var markupSignatures = [][]byte{
+	[]byte("<script"),
+	[]byte("<html"),
+	[]byte("<!doctype html"),
+	[]byte("<iframe"),
+	[]byte("<svg"),
+	[]byte("<?php"),
+}
+
+// Active content that is looked for in vendor data after a JPEG, on top of
+// markup: ZIP archives, which also covers JARs and Office documents, and
+// PDFs. Signatures are matched lowercased.
+var trailerSignatures = append([][]byte{
+	[]byte("pk\x03\x04"),
+	[]byte("%pdf"),
+}, markupSignatures...)
+
+// IsPolyglot reports whether the file could also be interpreted as another
+// kind of file: either it carries data after the end of the image, where
+// archives and scripts usually hide, or its metadata embeds HTML, SVG or
+// PHP markup. JPEGs are an exception, cameras append more images and
+// vendor data to them, see scanJPEGTrailer. Compressed pixel data isn't
+// scanned, random bytes match short signatures too often. The file is read
+// once without being held in memory.
+func IsPolyglot(r io.Reader, format string) (bool, error) {
+	scanner := &signatureScanner{signatures: markupSignatures}
+	br := bufio.NewReader(r)
+
+	var ended bool
+	var err error
+	switch format {
+	case "jpeg":
+		ended, err = skipJPEG(br, scanner)
+	case "png":
+		ended, err = skipPNG(br, scanner)
+	case "gif":
+		_, err = scanGIF(br, scanner)
+		ended = err == nil
+	default:
+		// Without knowing where the metadata is, everything is scanned
+		_, err = io.Copy(scanner, br)
+	}
+	// Files without an end marker are truncated, decoding rejects them
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrMalformedImage) {
+		return false, err
+	}
+
+	if ended && format == "jpeg" {
+		active, err := scanJPEGTrailer(br, scanner)
+		if err != nil {
+			return false, err
+		}
+		return scanner.found || active, nil
+	}
+
+	trailing, err := hasTrailingData(br)
+	if err != nil {
+		return false, err
+	}
+	return scanner.found || (ended && trailing), nil
+}
+
+// signatureScanner looks for signatures in everything written to it,
+// including signatures split across writes
+type signatureScanner struct {
+	signatures [][]byte
+	tail       []byte
+	found      bool
+}
+
+func (s *signatureScanner) Write(p []byte) (int, error) {
+	if s.found {
+		return len(p), nil
+	}
+
+	data := bytes.ToLower(append(s.tail, p...))
+	longest := 0
+	for _, signature := range s.signatures {
+		if bytes.Contains(data, signature) {
+			s.found = true
+			return len(p), nil
+		}
+		longest = max(longest, len(signature))
+	}
+
+	keep := min(len(data), longest-1)
+	s.tail = append(s.tail[:0], data[len(data)-keep:]...)
+	return len(p), nil
+}
+
+// hasTrailingData consumes the rest of r. Some encoders pad files with
+// zero bytes, which is harmless.
+func hasTrailingData(r io.Reader) (bool, error) {
+	buf := make([]byte, 32<<10)
+	found := false
+	for {
+		n, err := r.Read(buf)
+		if !found && len(bytes.Trim(buf[:n], "\x00")) > 0 {
+			found = true
+		}
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// scanJPEGTrailer consumes what follows the EOI of a JPEG and reports
+// whether it holds active content. Cameras store more images there, the
+// pictures of an MPF file or an Ultra HDR gain map, which are walked like
+// the first one with their metadata written to metadata. Anything else is
+// vendor data that may hold any bytes, so only trailerSignatures are
+// looked for in it. An image that doesn't end with EOI is active content,
+// its entropy coded data could hide anything.
+func scanJPEGTrailer(r *bufio.Reader, metadata io.Writer) (bool, error) {
+	for {
+		// Zero padding between images
+		b, err := r.Peek(1)
+		for err == nil && b[0] == 0x00 {
+			r.Discard(1)
+			b, err = r.Peek(1)
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if b, err := r.Peek(2); err != nil || !bytes.Equal(b, jpegSignature[:2]) {
+			trailer := &signatureScanner{signatures: trailerSignatures}
+			if _, err := io.Copy(trailer, r); err != nil {
+				return false, err
+			}
+			return trailer.found, nil
+		}
+
+		ended, err := skipJPEG(r, metadata)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrMalformedImage) {
+			return false, err
+		}
+		if !ended {
+			return true, nil
+		}
+	}
+}
+
+// skipJPEG reads up to and including the EOI marker, writing the segments
+// to metadata but not the entropy coded data following them
+func skipJPEG(r *bufio.Reader, metadata io.Writer) (bool, error) {
+	// SOI
+	if _, err := r.Discard(2); err != nil {
+		return false, err
+	}
+
+	marker, err := readJPEGMarker(r)
+	for {
+		if err != nil {
+			return false, err
+		}
+		if marker == 0xd9 {
+			return true, nil
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return false, err
+		}
+		if length < 2 {
+			return false, ErrMalformedImage
+		}
+		if _, err := io.CopyN(metadata, r, int64(length)-2); err != nil {
+			return false, err
+		}
+
+		if marker == 0xda {
+			marker, err = skipJPEGScan(r)
+		} else {
+			marker, err = readJPEGMarker(r)
+		}
+	}
+}
+
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, ErrMalformedImage
+	}
+	// Fill bytes before a marker
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// skipJPEGScan skips the entropy coded data following a start of scan and
+// returns the marker after it. Inside the data 0xff is always followed by
+// a stuffed zero or a restart marker.
+func skipJPEGScan(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			continue
+		}
+		for b == 0xff {
+			if b, err = r.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b != 0x00 && (b < 0xd0 || b > 0xd7) {
+			return b, nil
+		}
+	}
+}
+
+// skipPNG reads up to and including the IEND chunk, writing every chunk
+// but the image data to metadata
+func skipPNG(r *bufio.Reader, metadata io.Writer) (bool, error) {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return false, err
+	}
+
+	header := make([]byte, 8)
+	for {
+		// length, type, data and CRC
+		if _, err := io.ReadFull(r, header); err != nil {
+			return false, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		data := metadata
+		if string(header[4:8]) == "IDAT" {
+			data = io.Discard
+		}
+		if _, err := io.CopyN(data, r, length); err != nil {
+			return false, err
+		}
+		// CRC
+		if _, err := r.Discard(4); err != nil {
+			return false, err
+		}
+		if string(header[4:8]) == "IEND" {
+			return true, nil
+		}
+	}
+}
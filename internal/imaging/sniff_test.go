@@ -0,0 +1,81 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Intn(256))
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withSegment inserts a marker segment right after the SOI of a JPEG
+func withSegment(data []byte, marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, data[2:]...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestIsPolyglotJPEGTrailers(t *testing.T) {
+	primary := encodeJPEG(t, 64, 48)
+	// MPF index declaring a second picture, the contents don't matter here
+	mpf := withSegment(primary, 0xe2, append([]byte("MPF\x00"), make([]byte, 64)...))
+	gainMap := encodeJPEG(t, 16, 12)
+
+	vendor := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(vendor)
+	vendor = concat([]byte("SEFH"), vendor, []byte("SEFT"))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		polyglot bool
+	}{
+		{"plain", primary, false},
+		{"zero padding", concat(primary, make([]byte, 128)), false},
+		{"MPF second picture", concat(mpf, gainMap), false},
+		{"gain map after padding", concat(primary, make([]byte, 16), gainMap), false},
+		{"several pictures", concat(mpf, gainMap, gainMap), false},
+		{"vendor trailer", concat(primary, vendor), false},
+		{"picture and vendor trailer", concat(mpf, gainMap, vendor), false},
+		{"zip", concat(primary, []byte("PK\x03\x04\x14\x00\x00\x00"), vendor), true},
+		{"pdf", concat(primary, []byte("%PDF-1.7\n")), true},
+		{"script", concat(primary, []byte("<script>alert(1)</script>")), true},
+		{"zip after picture", concat(mpf, gainMap, []byte("PK\x03\x04")), true},
+		{"truncated picture", concat(primary, gainMap[:len(gainMap)/2]), true},
+		{"markup in picture metadata", concat(primary, withSegment(gainMap, 0xfe, []byte("<svg onload=x>"))), true},
+		{"markup in metadata", withSegment(primary, 0xfe, []byte("<?php echo 1; ?>")), true},
+	}
+	for _, tt := range tests {
+		polyglot, err := IsPolyglot(bytes.NewReader(tt.data), "jpeg")
+		if err != nil {
+			t.Errorf("%s: IsPolyglot = %v", tt.name, err)
+			continue
+		}
+		if polyglot != tt.polyglot {
+			t.Errorf("%s: IsPolyglot = %v, want %v", tt.name, polyglot, tt.polyglot)
+		}
+	}
+}
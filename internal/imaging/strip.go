@@ -0,0 +1,234 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	jpegSignature = []byte{0xff, 0xd8, 0xff}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+
+	ErrMalformedImage = errors.New("malformed image")
+)
+
+// JPEG segments dropped when stripping metadata. ICC profiles (APP2) are
+// kept since they affect how colors are displayed.
+var strippedJPEGMarkers = map[byte]bool{
+	0xe1: true, // APP1: EXIF and XMP
+	0xed: true, // APP13: IPTC
+	0xfe: true, // COM
+}
+
+// PNG chunks dropped when stripping metadata
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// StripMetadata removes EXIF (including GPS), XMP, IPTC and comments from
+// JPEG images and text and EXIF chunks from PNG images, without touching
+// the pixel data. A JPEG orientation other than upright is preserved in a
+// minimal EXIF segment so the image keeps displaying correctly. Other
+// formats are returned unchanged.
+func StripMetadata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	if err := StripMetadataTo(out, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// StripMetadataTo is StripMetadata for streams. Only the JPEG header
+// segments are held in memory, the pixel data is copied through.
+func StripMetadataTo(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	signature, err := br.Peek(len(pngSignature))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(signature, jpegSignature):
+		header, err := readJPEGHeader(br)
+		if err != nil {
+			return err
+		}
+		stripped, err := stripJPEG(header, Orientation(header))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(stripped); err != nil {
+			return err
+		}
+	case bytes.HasPrefix(signature, pngSignature):
+		return stripPNG(w, br)
+	}
+
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// readJPEGHeader reads every segment up to and including the start of
+// scan, where the metadata lives
+func readJPEGHeader(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2, 64<<10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, malformed(err)
+		}
+		if b != 0xff {
+			return nil, ErrMalformedImage
+		}
+		header = append(header, b)
+
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, malformed(err)
+		}
+		// Fill bytes before a marker
+		if marker == 0xff {
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		header = append(header, marker)
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, malformed(err)
+		}
+		header = append(header, length[:]...)
+
+		size := int(binary.BigEndian.Uint16(length[:])) - 2
+		if size < 0 {
+			return nil, ErrMalformedImage
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, malformed(err)
+		}
+		header = append(header, segment...)
+
+		if marker == 0xda {
+			return header, nil
+		}
+	}
+}
+
+func stripJPEG(data []byte, orientation int) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2]) // SOI
+
+	orientationWritten := orientation == 1
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, ErrMalformedImage
+		}
+		marker := data[pos+1]
+		// Fill bytes before a marker
+		if marker == 0xff {
+			pos++
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrMalformedImage
+		}
+
+		// The orientation goes after the JFIF header when there is one
+		if !orientationWritten && marker != 0xe0 {
+			out.Write(orientationSegment(orientation))
+			orientationWritten = true
+		}
+
+		// Start of scan, the rest is entropy coded image data
+		if marker == 0xda {
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+
+		if !strippedJPEGMarkers[marker] {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+}
+
+// orientationSegment builds an APP1 segment holding an EXIF block with
+// only the orientation tag
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, // big endian TIFF header
+		0x00, 0x00, 0x00, 0x08, // offset of the first IFD
+		0x00, 0x01, // one entry
+		0x01, 0x12, // orientation tag
+		0x00, 0x03, // SHORT
+		0x00, 0x00, 0x00, 0x01, // one value
+		0x00, byte(orientation), 0x00, 0x00, // value, padded to 4 bytes
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func stripPNG(w io.Writer, r io.Reader) error {
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return err
+	}
+
+	header := make([]byte, 8)
+	for {
+		// length, type, data and CRC
+		if _, err := io.ReadFull(r, header); err != nil {
+			return malformed(err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4])) + 4
+
+		chunkType := string(header[4:8])
+		if strippedPNGChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, r, length); err != nil {
+				return malformed(err)
+			}
+			continue
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return malformed(err)
+		}
+
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// malformed reports a stream that ends in the middle of a segment or chunk
+// as a malformed image
+func malformed(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformedImage
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Album is an ordered collection of a user's images
+type Album struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	Name   string `gorm:"not null"`
+	// Image shown for the album, one of its images or nil
+	CoverImageID *uint
+	Images       []AlbumImage
+}
+
+// AlbumImage places an image in an album, the album is sorted by Position
+type AlbumImage struct {
+	AlbumID         uint `gorm:"primaryKey"`
+	ImageMetadataID uint `gorm:"primaryKey;index"`
+	Position        int  `gorm:"not null"`
+	CreatedAt       time.Time
+}
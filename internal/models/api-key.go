@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+const (
+	// Read images, their metadata, albums and tags
+	ScopeImagesRead = "images:read"
+	// Upload and edit images, albums and tags
+	ScopeImagesWrite = "images:write"
+	// Delete images
+	ScopeImagesDelete = "images:delete"
+)
+
+var Scopes = []string{ScopeImagesRead, ScopeImagesWrite, ScopeImagesDelete}
+
+// APIKey lets machine clients act as a user with limited scopes. Only the
+// SHA-256 of the key is stored, the key itself is shown once on creation.
+type APIKey struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"not null;index"`
+	Name      string `gorm:"not null"`
+	// Start of the key, so users can tell their keys apart
+	Prefix string `gorm:"not null"`
+	Hash   string `gorm:"not null;uniqueIndex"`
+	// Comma separated
+	Scopes string `gorm:"not null"`
+
+	// Nil for keys that never expire
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func ParseScope(value string) (string, bool) {
+	for _, scope := range Scopes {
+		if scope == value {
+			return scope, true
+		}
+	}
+	return "", false
+}
+
+// Active reports whether the key can be used at the given time
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Blob is stored file content, shared by every image with the same bytes.
+// The file is deleted from storage when the last image referencing it goes
+// away.
+type Blob struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	// Hex encoded SHA-256 of the content
+	Hash string `gorm:"not null;uniqueIndex"`
+	// The hash with a random suffix, so a blob deleted and created again
+	// doesn't share its file
+	Filename string `gorm:"not null"`
+	Format   string `gorm:"not null"`
+	Size     int64  `gorm:"not null"`
+	// Number of images using the blob
+	RefCount int64 `gorm:"not null;default:0"`
+}
+
+// MigrateBlobs creates the blobs of images stored before images shared
+// them, and drops the unique filename index they had
+func MigrateBlobs(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&ImageMetadata{}, "idx_image_metadata_filename") {
+		if err := db.Migrator().DropIndex(&ImageMetadata{}, "idx_image_metadata_filename"); err != nil {
+			return err
+		}
+	}
+
+	var images []ImageMetadata
+	if err := db.Where("blob_id IS NULL OR blob_id = 0").Find(&images).Error; err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			blob := Blob{
+				Hash:     strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename)),
+				Filename: image.Filename,
+				Format:   image.Format,
+				Size:     image.Size,
+			}
+			if err := tx.Where(Blob{Hash: blob.Hash}).FirstOrCreate(&blob).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&blob).Update("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+				return err
+			}
+			return tx.Model(&image).Update("blob_id", blob.ID).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
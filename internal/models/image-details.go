@@ -0,0 +1,18 @@
+package models
+
+// ImageDetails holds the descriptive fields supplied by the uploader
+type ImageDetails struct {
+	ID              uint `gorm:"primarykey"`
+	ImageMetadataID uint `gorm:"not null;uniqueIndex"`
+	Title           string
+	Description     string
+	AltText         string
+}
+
+// ImageProperty is a client defined key with a JSON encoded value
+type ImageProperty struct {
+	ID              uint   `gorm:"primarykey"`
+	ImageMetadataID uint   `gorm:"not null;uniqueIndex:idx_image_property_name"`
+	Name            string `gorm:"not null;uniqueIndex:idx_image_property_name"`
+	Value           string `gorm:"not null"`
+}
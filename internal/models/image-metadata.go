@@ -1,11 +1,78 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
 
+	"gorm.io/gorm"
+)
+
+type Visibility string
+
+const (
+	// Anyone can view the image
+	VisibilityPublic Visibility = "public"
+	// Anyone with the link can view the image, but it isn't listed
+	VisibilityUnlisted Visibility = "unlisted"
+	// Only the owner can view the image
+	VisibilityPrivate Visibility = "private"
+)
+
+var Visibilities = []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
+// ImageMetadata spells out the gorm.Model fields so CreatedAt can be part
+// of the composite indexes used when listing a user's images
 type ImageMetadata struct {
-	gorm.Model
-	Filename string `gorm:"unique;uniqueIndex;not null"`
-	Format   string `gorm:"not null"`
-	Size     int64  `gorm:"not null"`
-	UserID   uint
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index:idx_image_metadata_user_created,priority:2"`
+	UpdatedAt  time.Time
+	DeletedAt  gorm.DeletedAt `gorm:"index"`
+	Filename   string         `gorm:"not null"`
+	Format     string         `gorm:"not null;index"`
+	Size       int64          `gorm:"not null;index:idx_image_metadata_user_size,priority:2"`
+	UserID     uint           `gorm:"index:idx_image_metadata_user_created,priority:1;index:idx_image_metadata_user_size,priority:1"`
+	Visibility Visibility     `gorm:"not null;default:public"`
+	Tags       []Tag          `gorm:"many2many:image_tags;"`
+
+	// Stored content, shared by every image with the same bytes. Filename
+	// is copied from it.
+	BlobID uint `gorm:"index"`
+
+	// Fields supplied by the uploader
+	Details    *ImageDetails
+	Properties []ImageProperty
+
+	// Properties extracted from the image on upload
+	Width         int
+	Height        int
+	ColorModel    string
+	BitDepth      int
+	HasAlpha      bool
+	FrameCount    int
+	DominantColor string
+	CameraMake    string
+	CameraModel   string
+	TakenAt       *time.Time
+	Orientation   int
+	GPSLatitude   *float64
+	GPSLongitude  *float64
+}
+
+func ParseVisibility(value string) (Visibility, bool) {
+	for _, v := range Visibilities {
+		if string(v) == value {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// CanView reports whether the user may read the image, userID is 0 for
+// anonymous requests
+func (im *ImageMetadata) CanView(userID uint) bool {
+	return im.Visibility != VisibilityPrivate || (userID != 0 && im.UserID == userID)
+}
+
+// Animated reports whether the image is a GIF with more than one frame
+func (im *ImageMetadata) Animated() bool {
+	return im.Format == "gif" && im.FrameCount > 1
 }
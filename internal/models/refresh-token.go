@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// RefreshToken can be exchanged once for new tokens. Tokens issued from
+// the same login share a FamilyID, using a token twice revokes the whole
+// family since it means the token leaked.
+type RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint      `gorm:"not null;index"`
+	FamilyID  string    `gorm:"not null;index"`
+	Hash      string    `gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+
+	// Set once the token was exchanged
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
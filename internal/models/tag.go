@@ -0,0 +1,11 @@
+package models
+
+import "gorm.io/gorm"
+
+// Tag is a free-form label, each user has their own set of tags
+type Tag struct {
+	gorm.Model
+	Name   string          `gorm:"not null;uniqueIndex:idx_tag_user_name"`
+	UserID uint            `gorm:"not null;uniqueIndex:idx_tag_user_name"`
+	Images []ImageMetadata `gorm:"many2many:image_tags;"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Upload is a resumable upload in progress. Its data is kept in chunks
+// until Offset reaches Length and it's turned into an image.
+type Upload struct {
+	// Random and unguessable, it's the only credential of anonymous uploads
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null;index"`
+
+	Length      int64 `gorm:"not null"`
+	Offset      int64 `gorm:"not null;default:0"`
+	Filename    string
+	ContentType string
+
+	UserID        uint
+	Visibility    Visibility `gorm:"not null;default:public"`
+	StripMetadata bool
+
+	// Set once the upload is complete
+	ImageID *uint
+	Chunks  []UploadChunk
+}
+
+// UploadChunk is the data received by one request, stored under Filename
+type UploadChunk struct {
+	ID       uint   `gorm:"primarykey"`
+	UploadID string `gorm:"not null;index"`
+	Offset   int64  `gorm:"not null"`
+	Size     int64  `gorm:"not null"`
+	Filename string `gorm:"not null"`
+}
@@ -14,6 +14,8 @@ type User struct {
 	Password string `gorm:"not null"`
 	Email    string `gorm:"unique;uniqueIndex;not null"`
 	Images   []ImageMetadata
+	Albums   []Album
+	Tags     []Tag
 }
 
 type UserModel struct {
@@ -1,6 +1,9 @@
 package session
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/gorilla/sessions"
 )
 
@@ -8,6 +11,10 @@ var Store sessions.Store
 
 const Key = "AUTH_SESSION_KEY"
 
+type contextKey struct{}
+
+type scopesKey struct{}
+
 func InitStore(secret string) {
 	store := sessions.NewCookieStore([]byte(secret))
 	store.Options = &sessions.Options{
@@ -16,3 +23,55 @@ func InitStore(secret string) {
 
 	Store = store
 }
+
+// WithUserID attaches the authenticated user to the request context
+func WithUserID(r *http.Request, userID uint) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, userID))
+}
+
+// UserID returns the authenticated user, taken from the request context
+// when an auth middleware already resolved it and from the session cookie
+// otherwise
+func UserID(r *http.Request) (uint, bool) {
+	if userID, ok := r.Context().Value(contextKey{}).(uint); ok {
+		return userID, true
+	}
+
+	sess, err := Store.Get(r, Key)
+	if err != nil {
+		return 0, false
+	}
+
+	userID, ok := sess.Values["user_id"].(uint)
+	if !ok || userID == 0 {
+		return 0, false
+	}
+	return userID, true
+}
+
+// WithScopes limits what the authenticated request may do, as with API keys
+func WithScopes(r *http.Request, scopes []string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), scopesKey{}, scopes))
+}
+
+// Scoped reports whether the request is limited to scopes rather than
+// having the full access of a logged in user
+func Scoped(r *http.Request) bool {
+	_, ok := r.Context().Value(scopesKey{}).([]string)
+	return ok
+}
+
+// HasScope reports whether the request may use the scope. Requests that
+// aren't scoped, including anonymous ones, have every scope.
+func HasScope(r *http.Request, scope string) bool {
+	scopes, ok := r.Context().Value(scopesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
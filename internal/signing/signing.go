@@ -0,0 +1,78 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureParam = "sig"
+	ExpiresParam   = "expires"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature expired")
+)
+
+// Sign returns a copy of query with the signature, and the expiry when it
+// is not zero, added. The signature covers the path and every parameter.
+func Sign(key []byte, path string, query url.Values, expires time.Time) url.Values {
+	signed := url.Values{}
+	for name, values := range query {
+		if name != SignatureParam && name != ExpiresParam {
+			signed[name] = append([]string(nil), values...)
+		}
+	}
+	if !expires.IsZero() {
+		signed.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+
+	signed.Set(SignatureParam, signature(key, path, signed))
+	return signed
+}
+
+// Verify checks the signature and expiry carried by query
+func Verify(key []byte, path string, query url.Values, now time.Time) error {
+	sig := query.Get(SignatureParam)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+
+	expected := signature(key, path, query)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	if value := query.Get(ExpiresParam); value != "" {
+		expires, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		if now.Unix() > expires {
+			return ErrExpired
+		}
+	}
+
+	return nil
+}
+
+func signature(key []byte, path string, query url.Values) string {
+	canonical := url.Values{}
+	for name, values := range query {
+		if name != SignatureParam {
+			canonical[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, key)
+	// Encode sorts the parameters by name
+	mac.Write([]byte(path + "?" + canonical.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	// Host (and optional port) of the S3-compatible API, without scheme
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Address buckets as endpoint/bucket instead of bucket.endpoint,
+	// required by most self-hosted S3 implementations
+	PathStyle bool
+}
+
+// S3Storage keeps files in an S3-compatible bucket so several replicas
+// can share the same storage.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+
+	bucketLookup := minio.BucketLookupDNS
+	if cfg.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       cfg.UseSSL,
+		Region:       cfg.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{client: client, bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+func (s *S3Storage) Save(filename string, content io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(filename), content, -1, minio.PutObjectOptions{
+		// Unsigned payloads avoid aws-chunked encoding, which not every
+		// S3-compatible server understands
+		DisableContentSha256: true,
+		// Objects of unknown size are uploaded in parts buffered in memory,
+		// the default part size is large enough for the biggest objects S3
+		// allows
+		PartSize: 16 << 20,
+	})
+	return err
+}
+
+func (s *S3Storage) Open(filename string) (io.ReadSeekCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(filename), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.translateError(filename, err)
+	}
+	// GetObject doesn't send the request until the object is used, Stat
+	// does so missing objects are reported here rather than on Read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, s.translateError(filename, err)
+	}
+	return object, nil
+}
+
+func (s *S3Storage) Stat(filename string) (*FileInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(filename), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.translateError(filename, err)
+	}
+	return &FileInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// Move copies the object server side, S3 has no rename
+func (s *S3Storage) Move(src, dst string) error {
+	_, err := s.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(dst)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(src)},
+	)
+	if err != nil {
+		return s.translateError(src, err)
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(src), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Delete(filename string) error {
+	if filename == "" {
+		return fmt.Errorf("filename is required")
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(filename), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) key(filename string) string {
+	return path.Join(s.prefix, filename)
+}
+
+// translateError maps missing objects to fs.ErrNotExist so callers can
+// handle every backend the same way
+func (s *S3Storage) translateError(filename string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%s: %w", filename, fs.ErrNotExist)
+	}
+	return err
+}
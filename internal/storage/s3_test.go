@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+const testBucket = "images"
+
+// newTestS3Storage runs an in-process fake S3 server for the test
+func newTestS3Storage(t *testing.T) *S3Storage {
+	t.Helper()
+
+	backend := s3mem.New()
+	if err := backend.CreateBucket(testBucket); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(server.Close)
+
+	s, err := NewS3Storage(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    testBucket,
+		Prefix:    "prefix",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3Storage(t *testing.T) {
+	s := newTestS3Storage(t)
+	content := []byte("image data")
+
+	if err := s.Save("a/b.png", bytes.NewReader(content)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	info, err := s.Stat("a/b.png")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Stat size = %d, want %d", info.Size, len(content))
+	}
+
+	file, err := s.Open("a/b.png")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Open read %q, want %q", data, content)
+	}
+
+	if err := s.Move("a/b.png", "c.png"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := s.Stat("a/b.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Move = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := s.Stat("c.png"); err != nil {
+		t.Errorf("Stat of moved file: %v", err)
+	}
+
+	if err := s.Delete("c.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Stat("c.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Delete = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3StorageMissingKey(t *testing.T) {
+	s := newTestS3Storage(t)
+
+	if _, err := s.Open("missing.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := s.Stat("missing.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat = %v, want fs.ErrNotExist", err)
+	}
+}
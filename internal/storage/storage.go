@@ -2,20 +2,29 @@ package storage
 
 import (
 	"fmt"
-	"image"
 	"io"
 	"os"
 	"path/filepath"
-
-	"github.com/anthonynsimon/bild/imgio"
+	"time"
 )
 
 type Storage interface {
 	Save(filename string, content io.Reader) error
-	Get(filename string) (image.Image, error)
+	// Open returns the raw stored bytes. Storage never decodes images,
+	// callers check their limits first.
+	Open(filename string) (io.ReadSeekCloser, error)
+	Stat(filename string) (*FileInfo, error)
+	// Move renames a file, replacing dst if it exists. Readers never see
+	// dst partially written.
+	Move(src, dst string) error
 	Delete(filename string) error
 }
 
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
 type LocalStorage struct {
 	// Base path to store the files
 	root string
@@ -42,9 +51,26 @@ func (ls *LocalStorage) Save(filename string, content io.Reader) error {
 	return err
 }
 
-func (ls *LocalStorage) Get(filename string) (image.Image, error) {
+func (ls *LocalStorage) Open(filename string) (io.ReadSeekCloser, error) {
 	fullPath := filepath.Join(ls.root, filename)
-	return imgio.Open(fullPath)
+	return os.Open(fullPath)
+}
+
+func (ls *LocalStorage) Stat(filename string) (*FileInfo, error) {
+	fullPath := filepath.Join(ls.root, filename)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (ls *LocalStorage) Move(src, dst string) error {
+	fullPath := filepath.Join(ls.root, dst)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(ls.root, src), fullPath)
 }
 
 func (ls *LocalStorage) Delete(filename string) error {